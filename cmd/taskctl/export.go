@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/goinggo/task/data"
+	"io"
+	"os"
+	"time"
+)
+
+//** PRIVATE FUNCTIONS
+
+// exportCommand writes the jobs matching the filter flags to a file or stdout
+func exportCommand(arguments []string) (err error) {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", data.EXPORT_FORMAT_JSONL, "Archive format, jsonl or csv")
+	output := flags.String("out", "", "File to write, defaults to stdout")
+	jobType := flags.String("type", "", "Only export jobs of this type")
+	status := flags.String("status", "", "Only export jobs with this status")
+	from := flags.String("from", "", "Only export jobs started on or after this date (2006-01-02)")
+	to := flags.String("to", "", "Only export jobs started before this date (2006-01-02)")
+	labels := flags.String("labels", "", "Only export jobs with these labels (customer=acme,region=us)")
+
+	if err = flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	jobFilter := &data.JobFilter{
+		Type:   *jobType,
+		Status: *status,
+		Labels: data.ParseLabels(*labels),
+	}
+
+	if jobFilter.From, err = parseDate(*from); err != nil {
+		return err
+	}
+
+	if jobFilter.To, err = parseDate(*to); err != nil {
+		return err
+	}
+
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+		writer = file
+	}
+
+	count, err := data.ExportJobs(GO_ROUTINE, *useSession, *useDatabase, jobFilter, *format, writer)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d jobs\n", count)
+	return err
+}
+
+// importCommand loads an archive written by export
+func importCommand(arguments []string) (err error) {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", data.EXPORT_FORMAT_JSONL, "Archive format, jsonl or csv")
+	input := flags.String("in", "", "File to read, defaults to stdin")
+	overwrite := flags.Bool("overwrite", false, "Replace the archived fields of jobs that already exist instead of skipping them")
+
+	if err = flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	var reader io.Reader = os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+		reader = file
+	}
+
+	count, skipped, err := data.ImportJobs(GO_ROUTINE, *useSession, *useDatabase, *format, *overwrite, reader)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Imported %d jobs, skipped %d that already exist\n", count, skipped)
+	return err
+}
+
+// parseDate parses an optional date flag
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse("2006-01-02", value)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/goinggo/task/data"
+	"github.com/goinggo/task/helper"
+	"gopkg.in/mgo.v2/bson"
+	"os"
+	"os/user"
+	"text/tabwriter"
+	"time"
+)
+
+//** PRIVATE FUNCTIONS
+
+// listCommand prints the most recent jobs matching the filter flags
+func listCommand(arguments []string) (err error) {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	jobType := flags.String("type", "", "Only list jobs of this type")
+	status := flags.String("status", "", "Only list jobs with this status")
+	labels := flags.String("labels", "", "Only list jobs with these labels (customer=acme,region=us)")
+	limit := flags.Int("limit", 20, "Maximum number of jobs to list")
+
+	if err = flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	jobFilter := &data.JobFilter{
+		Type:   *jobType,
+		Status: *status,
+		Labels: data.ParseLabels(*labels),
+	}
+
+	jobs, err := data.ListJobs(GO_ROUTINE, *useSession, *useDatabase, jobFilter, *limit)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "ID\tTYPE\tSTATUS\tSTARTED\tDURATION\tLABELS\tACK\n")
+
+	for _, job := range jobs {
+		duration := "-"
+		if !job.EndDate.IsZero() {
+			duration = job.EndDate.Sub(job.StartDate).Round(time.Second).String()
+		}
+
+		acknowledged := ""
+		if job.Acknowledgement != nil {
+			acknowledged = job.Acknowledgement.Author
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", job.ObjectId.Hex(), job.Type, job.Status, job.StartDate.Format("2006-01-02 15:04:05"), duration, job.Labels, acknowledged)
+
+		for _, note := range job.Notes {
+			fmt.Fprintf(writer, "\t  %s %s: %s\t\t\t\t\t\n", note.Date.Format("2006-01-02 15:04"), note.Author, note.Text)
+		}
+	}
+
+	return writer.Flush()
+}
+
+// noteCommand adds an operator note to a job
+func noteCommand(arguments []string) (err error) {
+	flags := flag.NewFlagSet("note", flag.ContinueOnError)
+	jobId := flags.String("job", "", "Id of the job")
+	author := flags.String("author", "", "Author of the note, defaults to the current user")
+	text := flags.String("text", "", "Text of the note")
+	acknowledge := flags.Bool("ack", false, "Acknowledge the job's failure to suppress repeat alerts")
+
+	if err = flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	if !bson.IsObjectIdHex(*jobId) {
+		return fmt.Errorf("Invalid Job Id %s", *jobId)
+	}
+
+	if *text == "" {
+		return errors.New("Note Text Is Required")
+	}
+
+	if *author == "" {
+		if current, err := user.Current(); err == nil {
+			*author = current.Username
+		}
+	}
+
+	return data.AddJobNote(GO_ROUTINE, *useSession, *useDatabase, bson.ObjectIdHex(*jobId), *author, *text, *acknowledge)
+}
+
+// compareCommand compares two runs of a job type and prints or emails the summary
+func compareCommand(arguments []string) (err error) {
+	flags := flag.NewFlagSet("compare", flag.ContinueOnError)
+	jobType := flags.String("type", "", "Compare the last two finished runs of this type")
+	labels := flags.String("labels", "", "Only compare runs with these labels (customer=acme,region=us)")
+	baseId := flags.String("base", "", "Id of the earlier run, instead of -type")
+	otherId := flags.String("other", "", "Id of the later run, instead of -type")
+	html := flags.Bool("html", false, "Print the html summary instead of text")
+	email := flags.Bool("email", false, "Email the html summary using the email straps")
+
+	if err = flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	var jobComparison *data.JobComparison
+
+	switch {
+	case *baseId != "" || *otherId != "":
+		if !bson.IsObjectIdHex(*baseId) || !bson.IsObjectIdHex(*otherId) {
+			return errors.New("Both -base And -other Must Be Job Ids")
+		}
+
+		jobComparison, err = data.CompareJobs(GO_ROUTINE, *useSession, *useDatabase, bson.ObjectIdHex(*baseId), bson.ObjectIdHex(*otherId))
+
+	case *jobType != "":
+		jobComparison, err = data.CompareLatestJobs(GO_ROUTINE, *useSession, *useDatabase, *jobType, data.ParseLabels(*labels))
+
+	default:
+		return errors.New("Specify -type Or -base And -other")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if *email {
+		return helper.SendEmail(GO_ROUTINE, jobComparison.Subject(), jobComparison.HTML())
+	}
+
+	if *html {
+		fmt.Print(jobComparison.HTML())
+		return err
+	}
+
+	fmt.Print(jobComparison.Text())
+	return err
+}
@@ -0,0 +1,146 @@
+/*
+taskctl is an operator tool for the jobs recorded by task programs.
+
+Usage:
+
+	taskctl [-env TASK_ENV] [-path straps.xml] [-session master] [-database name] command [arguments]
+
+Commands:
+
+	export        Write job history to JSON Lines or CSV
+	import        Load job history written by export
+	list          List recent jobs with their notes
+	note          Add an operator note to a job
+	compare       Compare two runs of a job type
+	indexes       Create the registered indexes and report unregistered ones
+	migrate       Show, apply or roll back the registered migrations
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/goinggo/straps"
+	"github.com/goinggo/task/controller"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"os"
+	"sort"
+)
+
+//** CONSTANTS
+
+const (
+	GO_ROUTINE = "taskctl"
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	strapsEnv   = flag.String("env", "TASK_ENV", "Environment variable naming the straps environment")
+	strapsPath  = flag.String("path", "straps.xml", "Path to the straps file")
+	useSession  = flag.String("session", mongo.MASTER_SESSION, "Mongo session to use")
+	useDatabase = flag.String("database", "", "Database holding the jobs, defaults to the mgo_database strap")
+
+	// commands maps each command name to its implementation
+	commands = map[string]command{
+		"export":  {"Write job history to JSON Lines or CSV", exportCommand},
+		"import":  {"Load job history written by export", importCommand},
+		"list":    {"List recent jobs with their notes", listCommand},
+		"note":    {"Add an operator note to a job", noteCommand},
+		"compare": {"Compare two runs of a job type", compareCommand},
+		"indexes": {"Create the registered indexes and report unregistered ones", indexesCommand},
+		"migrate": {"Show, apply or roll back the registered migrations", migrateCommand},
+	}
+)
+
+//** TYPES
+
+type (
+	// command is a taskctl sub command
+	command struct {
+		description string
+		run         func(arguments []string) error
+	}
+
+	// taskControl implements the controller for taskctl
+	taskControl struct {
+		command   command
+		arguments []string
+	}
+)
+
+//** MAIN
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "taskctl: unknown command %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	os.Exit(controller.Run(&taskControl{
+		command:   command,
+		arguments: flag.Args()[1:],
+	}))
+}
+
+//** MEMBER FUNCTIONS
+
+// StrapEnv returns the environment and path for the straps file
+func (taskControl *taskControl) StrapEnv() (environment string, path string) {
+	return *strapsEnv, *strapsPath
+}
+
+// TimeoutSeconds returns zero so long exports and imports are not killed by the task timeout
+func (taskControl *taskControl) TimeoutSeconds() int {
+	return 0
+}
+
+// Run connects to mongo and runs the command
+func (taskControl *taskControl) Run() (err error) {
+	if err = mongo.Startup(GO_ROUTINE); err != nil {
+		return err
+	}
+
+	defer mongo.Shutdown(GO_ROUTINE)
+
+	if *useDatabase == "" {
+		*useDatabase = straps.Strap("mgo_database")
+	}
+
+	if err = taskControl.command.run(taskControl.arguments); err != nil {
+		tracelog.Error(err, GO_ROUTINE, "Run")
+		fmt.Fprintf(os.Stderr, "taskctl: %s\n", err)
+	}
+
+	return err
+}
+
+//** PRIVATE FUNCTIONS
+
+// usage prints the flags and commands
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: taskctl [flags] command [arguments]\n\nFlags:\n")
+	flag.PrintDefaults()
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", name, commands[name].description)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/goinggo/task/mongo"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+//** PRIVATE FUNCTIONS
+
+// indexesCommand creates the registered indexes and prints what was found. Indexes registered
+// without a database are checked in the -database database.
+func indexesCommand(arguments []string) (err error) {
+	flags := flag.NewFlagSet("indexes", flag.ContinueOnError)
+	drop := flags.Bool("drop", false, "Drop the indexes that are not registered")
+
+	if err = flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	indexReport, err := mongo.EnsureIndexes(GO_ROUTINE, *useDatabase, *drop)
+	if err != nil {
+		return err
+	}
+
+	printIndexes("Created", indexReport.Created)
+	printIndexes("Changed", indexReport.Changed)
+	printIndexes("Extra", indexReport.Extra)
+	printIndexes("Dropped", indexReport.Dropped)
+	return err
+}
+
+// migrateCommand prints the migration status, or applies or rolls back migrations. The data
+// package registers its migrations, so taskctl sees them next to any registered by imports.
+// -apply applies the pending migrations, -down rolls back the migrations newer than -to, and
+// -to limits -apply to that version. -to needs -namespace.
+func migrateCommand(arguments []string) (err error) {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	apply := flags.Bool("apply", false, "Apply the pending migrations")
+	down := flags.Bool("down", false, "Roll back the migrations newer than -to")
+	namespace := flags.String("namespace", "", "Only the migrations in this namespace")
+	target := flags.Int("to", 0, "Version to migrate to within -namespace, the latest when applying")
+	lockDuration := flags.Duration("lock", mongo.DEFAULT_MIGRATION_LOCK_DURATION, "How long the migration lock is held between renewals")
+
+	if err = flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	migrationOptions := mongo.MigrationOptions{
+		Namespace:    *namespace,
+		Target:       *target,
+		LockDuration: *lockDuration,
+	}
+
+	var migrations []mongo.Migration
+
+	switch {
+	case *apply && *down:
+		return errors.New("Specify Only One Of -apply And -down")
+
+	case *apply:
+		migrations, err = mongo.MigrateUp(GO_ROUTINE, *useSession, *useDatabase, migrationOptions)
+		fmt.Fprintf(os.Stderr, "Applied migrations %v\n", migrations)
+		return err
+
+	case *down:
+		migrations, err = mongo.MigrateDown(GO_ROUTINE, *useSession, *useDatabase, migrationOptions)
+		fmt.Fprintf(os.Stderr, "Rolled back migrations %v\n", migrations)
+		return err
+	}
+
+	migrationStates, lock, err := mongo.MigrationStatus(GO_ROUTINE, *useSession, *useDatabase)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAMESPACE\tVERSION\tAPPLIED\tDESCRIPTION")
+
+	for _, migrationState := range migrationStates {
+		if *namespace != "" && migrationState.Namespace != *namespace {
+			continue
+		}
+
+		applied := "pending"
+		if !migrationState.Applied.IsZero() {
+			applied = migrationState.Applied.Format(time.RFC3339)
+		}
+
+		description := migrationState.Description
+		if !migrationState.Registered {
+			description += " (not registered)"
+		}
+
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\n", migrationState.Namespace, migrationState.Version, applied, description)
+	}
+
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+
+	if lock != nil {
+		fmt.Printf("Locked by %s until %s\n", lock.Owner, lock.Expires.Format(time.RFC3339))
+	}
+
+	return err
+}
+
+// printIndexes prints one section of the index report
+func printIndexes(title string, names []string) {
+	fmt.Printf("%s: %d\n", title, len(names))
+	for _, name := range names {
+		fmt.Printf("  %s\n", name)
+	}
+}
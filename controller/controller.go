@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -21,6 +22,10 @@ const (
 
 var (
 	_This *controlManager
+
+	shutdownHooks  []func()   // Run when the program stops or is killed by the timeout
+	interruptHooks []func()   // Run when the program is interrupted
+	hooksMutex     sync.Mutex // Protects the hooks
 )
 
 //** TYPES
@@ -37,6 +42,13 @@ type (
 		StrapEnv() (environment string, path string)
 		Run() (err error)
 	}
+
+	// TimeoutController is implemented by programs that set their own timeout instead of
+	// using the timeoutSeconds strap. Zero runs the program without a timeout.
+	TimeoutController interface {
+		Controller
+		TimeoutSeconds() int
+	}
 )
 
 //** PUBLIC FUNCTIONS
@@ -69,6 +81,22 @@ func Run(userControl Controller) (osExit int) {
 	return
 }
 
+// OnShutdown registers a function to run when the program stops, including when it is killed by
+// the timeout. Packages call it from init to flush what they buffer. Hooks run in registration order.
+func OnShutdown(hook func()) {
+	hooksMutex.Lock()
+	shutdownHooks = append(shutdownHooks, hook)
+	hooksMutex.Unlock()
+}
+
+// OnInterrupt registers a function to run when the program is interrupted, so work that is waiting
+// can give up before the program is asked to shut down
+func OnInterrupt(hook func()) {
+	hooksMutex.Lock()
+	interruptHooks = append(interruptHooks, hook)
+	hooksMutex.Unlock()
+}
+
 // Isshutdown returns the value of the shutdown flag
 func IsShutdown() bool {
 	value := atomic.LoadInt32(&_This.shutdown)
@@ -101,6 +129,9 @@ func (controlManager *controlManager) init() (err error) {
 	// Load the straps file
 	straps.MustLoad(environment, path)
 
+	// Capture the environment name for job metadata
+	helper.Environment = os.Getenv(environment)
+
 	// Capture the global email settings
 	helper.EmailHost = straps.Strap("emailHost")
 	helper.EmailPort = straps.StrapInt("emailPort")
@@ -133,8 +164,16 @@ func (controlManager *controlManager) start() (err error) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt)
 
-	// Set the timeout channel
-	timeout := time.After(time.Duration(helper.TimeoutSeconds) * time.Second)
+	// Programs can replace the strap so waits inside the program see the same timeout
+	if timeoutController, ok := controlManager.userControl.(TimeoutController); ok {
+		helper.TimeoutSeconds = timeoutController.TimeoutSeconds()
+	}
+
+	// Set the timeout channel, a nil channel never fires so zero means no timeout
+	var timeout <-chan time.Time
+	if helper.TimeoutSeconds > 0 {
+		timeout = time.After(time.Duration(helper.TimeoutSeconds) * time.Second)
+	}
 
 	// Launch the process
 	tracelog.Trace("main", "start", "******> Launch Task")
@@ -149,10 +188,16 @@ ControlLoop:
 
 			// Set the flag to indicate the program should shutdown early
 			atomic.StoreInt32(&_This.shutdown, 1)
+
+			// Let waiting work give up
+			runHooks(&interruptHooks)
 			continue
 
 		case <-timeout:
 			tracelog.Trace("main", "start", "Timeout - Killing Program")
+
+			// Don't lose buffered work
+			runHooks(&shutdownHooks)
 			os.Exit(1)
 
 		case err = <-complete:
@@ -170,6 +215,9 @@ ControlLoop:
 func (controlManager *controlManager) stop() (err error) {
 	defer helper.CatchPanic(&err, "main", "stop")
 
+	// Write anything the packages buffered
+	runHooks(&shutdownHooks)
+
 	// shutdown the log system
 	tracelog.Stop()
 
@@ -192,3 +240,16 @@ func (controlManager *controlManager) launchProcessor(complete chan error) {
 
 	tracelog.Completed("launch", "launchProcessor")
 }
+
+//** PRIVATE FUNCTIONS
+
+// runHooks runs the registered hooks in order
+func runHooks(hooks *[]func()) {
+	hooksMutex.Lock()
+	registered := append([]func(){}, *hooks...)
+	hooksMutex.Unlock()
+
+	for _, hook := range registered {
+		hook()
+	}
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/tracelog"
+	"html"
+	"sort"
+)
+
+//** PUBLIC FUNCTIONS
+
+// SendJobAlert emails an alert about the job. The job type and labels are added
+// to the subject and message so the affected tenant can be identified.
+func SendJobAlert(goRoutine string, job *Job, subject string, message string) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "SendJobAlert")
+
+	tracelog.Startedf(goRoutine, "SendJobAlert", "Id[%v] Type[%s] Labels[%s] Subject[%s]", job.ObjectId, job.Type, job.Labels, subject)
+
+	// Alerts are optional for programs that never configured email
+	if helper.EmailHost == "" {
+		tracelog.Completedf(goRoutine, "SendJobAlert", "Email Not Configured")
+		return err
+	}
+
+	subject = fmt.Sprintf("%s : %s", subject, job.Type)
+	if len(job.Labels) > 0 {
+		subject = fmt.Sprintf("%s [%s]", subject, job.Labels)
+	}
+
+	// Build the message
+	body := new(bytes.Buffer)
+	body.WriteString(fmt.Sprintf("%s<br /><br />", html.EscapeString(message)))
+	body.WriteString(fmt.Sprintf("Job: %s<br />", job.ObjectId.Hex()))
+	body.WriteString(fmt.Sprintf("Type: %s<br />", html.EscapeString(job.Type)))
+	body.WriteString(fmt.Sprintf("Started: %s<br />", job.StartDate.Format("2006-01-02 15:04:05 MST")))
+
+	// Identify the binary so failures can be tied to a deploy
+	if job.Host != nil {
+		body.WriteString(fmt.Sprintf("Host: %s (pid %d) %s<br />", html.EscapeString(job.Host.Hostname), job.Host.PID, html.EscapeString(job.Host.Environment)))
+		body.WriteString(fmt.Sprintf("Build: %s %s %s %s<br />", html.EscapeString(job.Host.Module), html.EscapeString(job.Host.Version), html.EscapeString(job.Host.Revision), job.Host.GoVersion))
+	}
+
+	keys := make([]string, 0, len(job.Labels))
+	for key := range job.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		body.WriteString(fmt.Sprintf("%s: %s<br />", html.EscapeString(key), html.EscapeString(job.Labels[key])))
+	}
+
+	if err = helper.SendEmail(goRoutine, subject, body.String()); err != nil {
+		tracelog.CompletedError(err, goRoutine, "SendJobAlert")
+		return err
+	}
+
+	tracelog.Completed(goRoutine, "SendJobAlert")
+	return err
+}
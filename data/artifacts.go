@@ -0,0 +1,207 @@
+package data
+
+import (
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	ARTIFACTS_PREFIX = "data_artifacts"
+)
+
+//** TYPES
+
+type (
+	// ArtifactMetadata ties an artifact to its job
+	ArtifactMetadata struct {
+		JobId        bson.ObjectId `bson:"job_id"`
+		JobType      string        `bson:"job_type"`
+		JobStartDate time.Time     `bson:"job_start_date"`
+	}
+
+	// Artifact describes a file stored in GridFS for a job
+	Artifact struct {
+		ObjectId    bson.ObjectId    `bson:"_id"`
+		Name        string           `bson:"filename"`
+		ContentType string           `bson:"contentType"`
+		Size        int64            `bson:"length"`
+		UploadDate  time.Time        `bson:"uploadDate"`
+		MD5         string           `bson:"md5"`
+		Metadata    ArtifactMetadata `bson:"metadata"`
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// AttachArtifact stores the contents of the reader in GridFS as an artifact of the job
+func AttachArtifact(goRoutine string, useSession string, useDatabase string, job *Job, name string, contentType string, reader io.Reader) (artifact *Artifact, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "AttachArtifact")
+
+	tracelog.Startedf(goRoutine, "AttachArtifact", "UseSession[%s] UseDatabase[%s] Id[%v] Name[%s] ContentType[%s]", useSession, useDatabase, job.ObjectId, name, contentType)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "AttachArtifact")
+		return artifact, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	gridFS := artifactsGridFS(mongoSession, useDatabase)
+
+	file, err := gridFS.Create(name)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "AttachArtifact")
+		return artifact, err
+	}
+
+	file.SetContentType(contentType)
+	file.SetMeta(&ArtifactMetadata{
+		JobId:        job.ObjectId,
+		JobType:      job.Type,
+		JobStartDate: job.StartDate,
+	})
+
+	if _, err = io.Copy(file, reader); err != nil {
+		// Abort makes Close remove the chunks that were written
+		file.Abort()
+		file.Close()
+		tracelog.CompletedError(err, goRoutine, "AttachArtifact")
+		return artifact, err
+	}
+
+	// Close waits for the chunks to be written and saves the file document
+	err = mongo.Measure(goRoutine, gridFS.Files, "AttachArtifact", bson.M{"filename": name}, file.Close)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "AttachArtifact")
+		return artifact, err
+	}
+
+	artifact = &Artifact{}
+	err = mongo.Measure(goRoutine, gridFS.Files, "FindArtifact", bson.M{"_id": file.Id()}, func() error {
+		return gridFS.Files.FindId(file.Id()).One(artifact)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "AttachArtifact")
+		return artifact, err
+	}
+
+	tracelog.Completedf(goRoutine, "AttachArtifact", "ArtifactId[%v] Size[%d]", artifact.ObjectId, artifact.Size)
+	return artifact, err
+}
+
+// ListArtifacts returns the artifacts attached to the job in upload order
+func ListArtifacts(goRoutine string, useSession string, useDatabase string, job *Job) (artifacts []Artifact, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "ListArtifacts")
+
+	tracelog.Startedf(goRoutine, "ListArtifacts", "UseSession[%s] UseDatabase[%s] Id[%v]", useSession, useDatabase, job.ObjectId)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ListArtifacts")
+		return artifacts, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	gridFS := artifactsGridFS(mongoSession, useDatabase)
+
+	query := bson.M{"metadata.job_id": job.ObjectId}
+
+	err = mongo.Measure(goRoutine, gridFS.Files, "ListArtifacts", query, func() error {
+		return gridFS.Find(query).Sort("uploadDate").All(&artifacts)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ListArtifacts")
+		return artifacts, err
+	}
+
+	tracelog.Completedf(goRoutine, "ListArtifacts", "Count[%d]", len(artifacts))
+	return artifacts, err
+}
+
+// DownloadArtifact writes the contents of the artifact to the writer
+func DownloadArtifact(goRoutine string, useSession string, useDatabase string, artifactId bson.ObjectId, writer io.Writer) (artifact *Artifact, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "DownloadArtifact")
+
+	tracelog.Startedf(goRoutine, "DownloadArtifact", "UseSession[%s] UseDatabase[%s] ArtifactId[%v]", useSession, useDatabase, artifactId)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "DownloadArtifact")
+		return artifact, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	gridFS := artifactsGridFS(mongoSession, useDatabase)
+
+	artifact = &Artifact{}
+	err = mongo.Measure(goRoutine, gridFS.Files, "FindArtifact", bson.M{"_id": artifactId}, func() error {
+		return gridFS.Files.FindId(artifactId).One(artifact)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "DownloadArtifact")
+		return nil, err
+	}
+
+	file, err := gridFS.OpenId(artifactId)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "DownloadArtifact")
+		return artifact, err
+	}
+
+	defer file.Close()
+
+	if _, err = io.Copy(writer, file); err != nil {
+		tracelog.CompletedError(err, goRoutine, "DownloadArtifact")
+		return artifact, err
+	}
+
+	tracelog.Completed(goRoutine, "DownloadArtifact")
+	return artifact, err
+}
+
+//** PRIVATE FUNCTIONS
+
+// artifactsGridFS returns the GridFS holding job artifacts
+func artifactsGridFS(mongoSession *mgo.Session, useDatabase string) *mgo.GridFS {
+	return mongoSession.DB(useDatabase).GridFS(ARTIFACTS_PREFIX)
+}
+
+// removeArtifacts removes the artifacts matching the query on the files collection
+func removeArtifacts(goRoutine string, mongoSession *mgo.Session, useDatabase string, query bson.M) (count int, err error) {
+	gridFS := artifactsGridFS(mongoSession, useDatabase)
+
+	var artifact Artifact
+	iter := gridFS.Find(query).Select(bson.M{"_id": 1}).Iter()
+
+	for iter.Next(&artifact) {
+		err = mongo.Measure(goRoutine, gridFS.Files, "RemoveArtifact", bson.M{"_id": artifact.ObjectId}, func() error {
+			return gridFS.RemoveId(artifact.ObjectId)
+		})
+		if err != nil {
+			iter.Close()
+			return count, err
+		}
+
+		count++
+	}
+
+	if err = iter.Close(); err != nil {
+		return count, err
+	}
+
+	tracelog.Trace(goRoutine, "removeArtifacts", "Info : Removed Artifacts : Count[%d] Query[%s]", count, mongo.ToString(query))
+	return count, err
+}
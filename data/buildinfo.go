@@ -0,0 +1,68 @@
+package data
+
+import (
+	"github.com/goinggo/task/helper"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	jobHost     JobHost   // Build and host metadata that cannot change while the process runs
+	jobHostOnce sync.Once // Captures jobHost the first time it is needed
+)
+
+//** TYPES
+
+type (
+	// JobHost records the process and binary that ran a job
+	JobHost struct {
+		Hostname    string `bson:"hostname" json:"hostname"`
+		PID         int    `bson:"pid" json:"pid"`
+		GoVersion   string `bson:"go_version" json:"go_version"`
+		Module      string `bson:"module,omitempty" json:"module,omitempty"`
+		Version     string `bson:"version,omitempty" json:"version,omitempty"`
+		Revision    string `bson:"revision,omitempty" json:"revision,omitempty"`
+		RevisionAt  string `bson:"revision_time,omitempty" json:"revision_time,omitempty"`
+		Modified    bool   `bson:"modified,omitempty" json:"modified,omitempty"`
+		Environment string `bson:"environment,omitempty" json:"environment,omitempty"`
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// CurrentHost returns the build and host metadata recorded on jobs started by this process.
+// The environment is read on every call since the controller sets it after packages load.
+func CurrentHost() *JobHost {
+	jobHostOnce.Do(func() {
+		jobHost.Hostname, _ = os.Hostname()
+		jobHost.PID = os.Getpid()
+		jobHost.GoVersion = runtime.Version()
+
+		buildInfo, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+
+		jobHost.Module = buildInfo.Main.Path
+		jobHost.Version = buildInfo.Main.Version
+
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				jobHost.Revision = setting.Value
+			case "vcs.time":
+				jobHost.RevisionAt = setting.Value
+			case "vcs.modified":
+				jobHost.Modified = setting.Value == "true"
+			}
+		}
+	})
+
+	host := jobHost
+	host.Environment = helper.Environment
+	return &host
+}
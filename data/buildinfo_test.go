@@ -0,0 +1,30 @@
+package data
+
+import (
+	"github.com/goinggo/task/helper"
+	"os"
+	"testing"
+)
+
+//** TESTS
+
+// TestCurrentHostEnvironment checks the environment is read on each call while the process
+// metadata is captured once
+func TestCurrentHostEnvironment(t *testing.T) {
+	defer func(environment string) {
+		helper.Environment = environment
+	}(helper.Environment)
+
+	for _, environment := range []string{"", "staging", "production"} {
+		helper.Environment = environment
+
+		host := CurrentHost()
+		if host.Environment != environment {
+			t.Errorf("Expected environment %q, got %q", environment, host.Environment)
+		}
+
+		if host.PID != os.Getpid() || host.GoVersion == "" {
+			t.Errorf("Expected the process metadata, got %+v", host)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2/bson"
+	htmltemplate "html/template"
+	"regexp"
+	"sort"
+	"text/template"
+	"time"
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// ErrNotEnoughRuns is returned when there are fewer than two finished runs to compare
+	ErrNotEnoughRuns = errors.New("Not Enough Finished Runs To Compare")
+
+	// numberPattern matches ids and counts so messages that differ only by them are treated alike
+	numberPattern = regexp.MustCompile(`[0-9]+`)
+
+	compareTextTemplate = template.Must(template.New("compareText").Parse(compareTextScript()))
+	compareHTMLTemplate = htmltemplate.Must(htmltemplate.New("compareHTML").Parse(compareHTMLScript()))
+)
+
+//** TYPES
+
+type (
+	// TaskCount compares the number of details recorded for a task in each run
+	TaskCount struct {
+		Task  string
+		Base  int
+		Other int
+	}
+
+	// JobComparison describes how a run differs from an earlier run of the same type
+	JobComparison struct {
+		Base          *Job
+		Other         *Job
+		BaseDuration  time.Duration
+		OtherDuration time.Duration
+		BaseDetails   int
+		OtherDetails  int
+		TaskCounts    []TaskCount // Every task recorded by either run
+		NewErrors     []string    // Error details in the other run not seen in the base run
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// CompareJobs compares two runs of the same job type
+func CompareJobs(goRoutine string, useSession string, useDatabase string, baseId bson.ObjectId, otherId bson.ObjectId) (jobComparison *JobComparison, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "CompareJobs")
+
+	tracelog.Startedf(goRoutine, "CompareJobs", "UseSession[%s] UseDatabase[%s] Base[%v] Other[%v]", useSession, useDatabase, baseId, otherId)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "CompareJobs")
+		return jobComparison, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "CompareJobs")
+		return jobComparison, err
+	}
+
+	base := &Job{}
+	err = mongo.Measure(goRoutine, collection, "CompareJobs", bson.M{"_id": baseId}, func() error {
+		return collection.FindId(baseId).One(base)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "CompareJobs")
+		return jobComparison, err
+	}
+
+	other := &Job{}
+	err = mongo.Measure(goRoutine, collection, "CompareJobs", bson.M{"_id": otherId}, func() error {
+		return collection.FindId(otherId).One(other)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "CompareJobs")
+		return jobComparison, err
+	}
+
+	if base.Type != other.Type {
+		err = fmt.Errorf("Cannot Compare Job Types %s And %s", base.Type, other.Type)
+		tracelog.CompletedError(err, goRoutine, "CompareJobs")
+		return jobComparison, err
+	}
+
+	jobComparison = NewJobComparison(base, other)
+
+	tracelog.Completed(goRoutine, "CompareJobs")
+	return jobComparison, err
+}
+
+// CompareLatestJobs compares the last two finished runs of the job type with the specified labels
+func CompareLatestJobs(goRoutine string, useSession string, useDatabase string, jobType string, labels Labels) (jobComparison *JobComparison, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "CompareLatestJobs")
+
+	tracelog.Startedf(goRoutine, "CompareLatestJobs", "UseSession[%s] UseDatabase[%s] JobType[%s] Labels[%s]", useSession, useDatabase, jobType, labels)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "CompareLatestJobs")
+		return jobComparison, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "CompareLatestJobs")
+		return jobComparison, err
+	}
+
+	query := LabelQuery(labels)
+	query["type"] = jobType
+	query["status"] = bson.M{"$in": []string{JOB_STATUS_COMPLETED, JOB_STATUS_FAILED}}
+
+	var jobs []Job
+	err = mongo.Retry(goRoutine, mongoSession, "CompareLatestJobs", mongo.Instrument(goRoutine, collection, "CompareLatestJobs", query, func() error {
+		return collection.Find(query).Sort("-start_date").Limit(2).All(&jobs)
+	}))
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "CompareLatestJobs")
+		return jobComparison, err
+	}
+
+	if len(jobs) < 2 {
+		tracelog.CompletedError(ErrNotEnoughRuns, goRoutine, "CompareLatestJobs")
+		return jobComparison, ErrNotEnoughRuns
+	}
+
+	jobComparison = NewJobComparison(&jobs[1], &jobs[0])
+
+	tracelog.Completed(goRoutine, "CompareLatestJobs")
+	return jobComparison, err
+}
+
+// NewJobComparison compares the other run against the base run
+func NewJobComparison(base *Job, other *Job) *JobComparison {
+	jobComparison := &JobComparison{
+		Base:          base,
+		Other:         other,
+		BaseDuration:  jobDuration(base),
+		OtherDuration: jobDuration(other),
+		BaseDetails:   len(base.Details),
+		OtherDetails:  len(other.Details),
+	}
+
+	counts := map[string]*TaskCount{}
+	for _, detail := range base.Details {
+		taskCount(counts, detail.Task).Base++
+	}
+
+	for _, detail := range other.Details {
+		taskCount(counts, detail.Task).Other++
+	}
+
+	for _, count := range counts {
+		jobComparison.TaskCounts = append(jobComparison.TaskCounts, *count)
+	}
+
+	sort.Slice(jobComparison.TaskCounts, func(i int, j int) bool {
+		return jobComparison.TaskCounts[i].Task < jobComparison.TaskCounts[j].Task
+	})
+
+	// Errors are new if nothing like them was seen in the base run
+	seen := map[string]bool{}
+	for _, message := range errorMessages(base) {
+		seen[numberPattern.ReplaceAllString(message, "#")] = true
+	}
+
+	for _, message := range errorMessages(other) {
+		key := numberPattern.ReplaceAllString(message, "#")
+		if !seen[key] {
+			seen[key] = true
+			jobComparison.NewErrors = append(jobComparison.NewErrors, message)
+		}
+	}
+
+	return jobComparison
+}
+
+//** MEMBER FUNCTIONS
+
+// Changed returns true if the runs differ in status, detail counts or errors
+func (jobComparison *JobComparison) Changed() bool {
+	if jobComparison.Base.Status != jobComparison.Other.Status || len(jobComparison.NewErrors) > 0 {
+		return true
+	}
+
+	for _, count := range jobComparison.TaskCounts {
+		if count.Base != count.Other {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DurationChange returns the change in duration as a percentage of the base run
+func (jobComparison *JobComparison) DurationChange() float64 {
+	if jobComparison.BaseDuration == 0 {
+		return 0
+	}
+
+	return float64(jobComparison.OtherDuration-jobComparison.BaseDuration) / float64(jobComparison.BaseDuration) * 100
+}
+
+// Subject returns a subject line for emailing the comparison
+func (jobComparison *JobComparison) Subject() string {
+	subject := fmt.Sprintf("Run Comparison : %s", jobComparison.Other.Type)
+	if len(jobComparison.Other.Labels) > 0 {
+		subject = fmt.Sprintf("%s [%s]", subject, jobComparison.Other.Labels)
+	}
+
+	if jobComparison.Changed() {
+		return subject + " : Changed"
+	}
+
+	return subject
+}
+
+// Text renders the comparison as plain text
+func (jobComparison *JobComparison) Text() string {
+	buffer := new(bytes.Buffer)
+	compareTextTemplate.Execute(buffer, jobComparison)
+	return buffer.String()
+}
+
+// HTML renders the comparison as an html fragment suitable for helper.SendEmail
+func (jobComparison *JobComparison) HTML() string {
+	buffer := new(bytes.Buffer)
+	compareHTMLTemplate.Execute(buffer, jobComparison)
+	return buffer.String()
+}
+
+//** PRIVATE FUNCTIONS
+
+// jobDuration returns how long the job ran, or zero if it has not ended
+func jobDuration(job *Job) time.Duration {
+	if job.EndDate.IsZero() {
+		return 0
+	}
+
+	return job.EndDate.Sub(job.StartDate).Round(time.Second)
+}
+
+// taskCount returns the count for the task, adding it if needed
+func taskCount(counts map[string]*TaskCount, task string) *TaskCount {
+	count, exists := counts[task]
+	if !exists {
+		count = &TaskCount{Task: task}
+		counts[task] = count
+	}
+
+	return count
+}
+
+// errorMessages returns the failure result and the details that report an error
+func errorMessages(job *Job) (messages []string) {
+	if job.Status == JOB_STATUS_FAILED && job.Result != "" {
+		messages = append(messages, job.Result)
+	}
+
+	for _, detail := range job.Details {
+		if detail.reportsError() {
+			messages = append(messages, fmt.Sprintf("%s: %s", detail.Task, detail.Details))
+		}
+	}
+
+	return messages
+}
+
+// compareTextScript returns the template for the plain text comparison
+func compareTextScript() string {
+	return `Run Comparison : {{.Other.Type}} {{.Other.Labels}}
+
+             Base                    Other
+Job          {{.Base.ObjectId.Hex}}  {{.Other.ObjectId.Hex}}
+Started      {{.Base.StartDate.Format "2006-01-02 15:04:05"}}     {{.Other.StartDate.Format "2006-01-02 15:04:05"}}
+Status       {{printf "%-24s" .Base.Status}}{{.Other.Status}}
+Duration     {{printf "%-24s" .BaseDuration.String}}{{.OtherDuration}} ({{printf "%+.1f" .DurationChange}}%)
+Details      {{printf "%-24d" .BaseDetails}}{{.OtherDetails}}
+
+Details By Task
+{{range .TaskCounts}}  {{printf "%-30s %8d %8d" .Task .Base .Other}}
+{{end}}
+New Errors
+{{range .NewErrors}}  {{.}}
+{{else}}  None
+{{end}}`
+}
+
+// compareHTMLScript returns the template for the html comparison
+func compareHTMLScript() string {
+	return `<h3>Run Comparison : {{.Other.Type}} {{.Other.Labels}}</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th></th><th>Base</th><th>Other</th></tr>
+<tr><td>Job</td><td>{{.Base.ObjectId.Hex}}</td><td>{{.Other.ObjectId.Hex}}</td></tr>
+<tr><td>Started</td><td>{{.Base.StartDate.Format "2006-01-02 15:04:05"}}</td><td>{{.Other.StartDate.Format "2006-01-02 15:04:05"}}</td></tr>
+<tr><td>Status</td><td>{{.Base.Status}}</td><td>{{.Other.Status}}</td></tr>
+<tr><td>Duration</td><td>{{.BaseDuration}}</td><td>{{.OtherDuration}} ({{printf "%+.1f" .DurationChange}}%)</td></tr>
+<tr><td>Details</td><td>{{.BaseDetails}}</td><td>{{.OtherDetails}}</td></tr>
+</table>
+<h4>Details By Task</h4>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Task</th><th>Base</th><th>Other</th></tr>
+{{range .TaskCounts}}<tr><td>{{.Task}}</td><td>{{.Base}}</td><td>{{.Other}}</td></tr>
+{{end}}</table>
+<h4>New Errors</h4>
+{{range .NewErrors}}{{.}}<br />
+{{else}}None<br />
+{{end}}`
+}
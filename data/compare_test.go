@@ -0,0 +1,65 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+//** TESTS
+
+// TestNewJobComparison checks durations, task counts and that only errors unlike those of the
+// base run are reported as new
+func TestNewJobComparison(t *testing.T) {
+	started := time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		base       Job
+		other      Job
+		taskCounts []TaskCount
+		newErrors  []string
+		changed    bool
+		change     float64
+	}{
+		{"same",
+			Job{Status: JOB_STATUS_COMPLETED, StartDate: started, EndDate: started.Add(time.Minute), Details: []JobDetail{{Task: "load"}}},
+			Job{Status: JOB_STATUS_COMPLETED, StartDate: started, EndDate: started.Add(time.Minute), Details: []JobDetail{{Task: "load"}}},
+			[]TaskCount{{Task: "load", Base: 1, Other: 1}}, nil, false, 0},
+		{"counts differ",
+			Job{Status: JOB_STATUS_COMPLETED, StartDate: started, EndDate: started.Add(time.Minute), Details: []JobDetail{{Task: "save"}, {Task: "load"}}},
+			Job{Status: JOB_STATUS_COMPLETED, StartDate: started, EndDate: started.Add(90 * time.Second), Details: []JobDetail{{Task: "load"}, {Task: "load"}, {Task: "report"}}},
+			[]TaskCount{{Task: "load", Base: 1, Other: 2}, {Task: "report", Base: 0, Other: 1}, {Task: "save", Base: 1, Other: 0}}, nil, true, 50},
+		{"errors differ only by number",
+			Job{Status: JOB_STATUS_COMPLETED, StartDate: started, Details: []JobDetail{{Task: "load", Details: "Error reading row 12"}}},
+			Job{Status: JOB_STATUS_COMPLETED, StartDate: started, Details: []JobDetail{{Task: "load", Details: "Error reading row 40"}}},
+			[]TaskCount{{Task: "load", Base: 1, Other: 1}}, nil, false, 0},
+		{"new errors",
+			Job{Status: JOB_STATUS_COMPLETED, StartDate: started, Details: []JobDetail{{Task: "load", Details: "Loaded"}}},
+			Job{Status: JOB_STATUS_FAILED, StartDate: started, Result: "Timed out", Details: []JobDetail{{Task: "load", Details: "Failed to connect"}, {Task: "load", Details: "Failed to connect"}}},
+			[]TaskCount{{Task: "load", Base: 1, Other: 2}}, []string{"Timed out", "load: Failed to connect"}, true, 0},
+	}
+
+	for _, test := range tests {
+		test.base.Type = "nightly"
+		test.other.Type = "nightly"
+
+		jobComparison := NewJobComparison(&test.base, &test.other)
+
+		if !reflect.DeepEqual(jobComparison.TaskCounts, test.taskCounts) {
+			t.Errorf("%s : Expected task counts %v, got %v", test.name, test.taskCounts, jobComparison.TaskCounts)
+		}
+
+		if !reflect.DeepEqual(jobComparison.NewErrors, test.newErrors) {
+			t.Errorf("%s : Expected new errors %q, got %q", test.name, test.newErrors, jobComparison.NewErrors)
+		}
+
+		if changed := jobComparison.Changed(); changed != test.changed {
+			t.Errorf("%s : Expected changed %v, got %v", test.name, test.changed, changed)
+		}
+
+		if change := jobComparison.DurationChange(); change != test.change {
+			t.Errorf("%s : Expected a duration change of %.1f%%, got %.1f%%", test.name, test.change, change)
+		}
+	}
+}
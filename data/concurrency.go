@@ -0,0 +1,430 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"github.com/goinggo/straps"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	LEASES_COLLECTION = "data_job_leases"
+
+	CONCURRENCY_MODE_EXIT  = "exit"
+	CONCURRENCY_MODE_WAIT  = "wait"
+	CONCURRENCY_MODE_QUEUE = "queue"
+
+	DEFAULT_LEASE_DURATION    = 2 * time.Minute
+	DEFAULT_CONCURRENCY_WAIT  = 30 * time.Minute
+	CONCURRENCY_POLL_INTERVAL = 5 * time.Second
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// ErrConcurrencyLimit is returned when the job type already has its limit of running jobs.
+	// The job is recorded as failed with this result.
+	ErrConcurrencyLimit = errors.New("Concurrency Limit Reached")
+
+	// ErrJobQueued is returned when the job type is at its limit in queue mode. The job is
+	// recorded as pending and runs when a worker claims it with ClaimJob or ClaimNextJob.
+	ErrJobQueued = errors.New("Job Queued Until A Concurrency Slot Is Free")
+
+	waitShutdown     = make(chan struct{}) // Closed by StopWaiting
+	waitShutdownOnce sync.Once             // Protects closing waitShutdown
+)
+
+//** TYPES
+
+type (
+	// ConcurrencyLimit caps the number of jobs of a type running at once across all hosts.
+	// It is configured with a strap named concurrency_<jobType> such as
+	// "limit=2,lease=2m,mode=wait,wait=30m". The mode is exit, wait or queue.
+	ConcurrencyLimit struct {
+		JobType string
+		Limit   int           // Jobs of the type allowed to run at once
+		Lease   time.Duration // A slot held by a host that stops renewing it is freed after this long
+		Mode    string        // What to do when no slot is free: exit, wait or queue
+		Wait    time.Duration // How long the wait mode waits before exiting, 30m when zero
+	}
+
+	// JobLease is a concurrency slot held by a running job
+	JobLease struct {
+		Id      string        `bson:"_id"`
+		Type    string        `bson:"type"`
+		JobId   bson.ObjectId `bson:"job_id"`
+		Host    string        `bson:"host"`
+		Expires time.Time     `bson:"expires"`
+	}
+
+	// jobLease renews the slot held by a running job until it is released
+	jobLease struct {
+		id       string
+		shutdown chan struct{}
+		once     sync.Once
+		lost     int32 // Set to 1 when another host took the slot over
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// LoadConcurrencyLimit reads the limit for the job type from straps. A nil limit is returned
+// when none is configured.
+func LoadConcurrencyLimit(jobType string) (concurrencyLimit *ConcurrencyLimit, err error) {
+	return parseConcurrencyLimit(jobType, straps.Strap("concurrency_"+jobType))
+}
+
+// ListLeases returns the concurrency slots currently held for the job type, or for all
+// job types when jobType is empty
+func ListLeases(goRoutine string, useSession string, useDatabase string, jobType string) (jobLeases []JobLease, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "ListLeases")
+
+	tracelog.Startedf(goRoutine, "ListLeases", "UseSession[%s] UseDatabase[%s] JobType[%s]", useSession, useDatabase, jobType)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ListLeases")
+		return jobLeases, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the leases collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, LEASES_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ListLeases")
+		return jobLeases, err
+	}
+
+	query := bson.M{"expires": bson.M{"$gte": time.Now()}}
+	if jobType != "" {
+		query["type"] = jobType
+	}
+
+	err = mongo.Measure(goRoutine, collection, "ListLeases", query, func() error {
+		return collection.Find(query).Sort("_id").All(&jobLeases)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ListLeases")
+		return jobLeases, err
+	}
+
+	tracelog.Completed(goRoutine, "ListLeases")
+	return jobLeases, err
+}
+
+// StopWaiting makes jobs waiting for a concurrency slot give up with ErrConcurrencyLimit.
+// It runs when the controller is interrupted, see hooks.go.
+func StopWaiting() {
+	waitShutdownOnce.Do(func() {
+		close(waitShutdown)
+	})
+}
+
+//** MEMBER FUNCTIONS
+
+// LeaseLost returns true if the job's concurrency slot expired and was taken over by another
+// job, so more jobs of the type are running than the limit allows. Long running tasks should
+// check it and stop.
+func (job *Job) LeaseLost() bool {
+	return job.lease != nil && atomic.LoadInt32(&job.lease.lost) == 1
+}
+
+// stop ends the renewal. It is safe to call more than once.
+func (lease *jobLease) stop() {
+	lease.once.Do(func() {
+		close(lease.shutdown)
+	})
+}
+
+//** PRIVATE FUNCTIONS
+
+// parseConcurrencyLimit parses the settings of a concurrency_<jobType> strap. A nil limit is
+// returned when the value is empty.
+func parseConcurrencyLimit(jobType string, value string) (concurrencyLimit *ConcurrencyLimit, err error) {
+	settings := ParseLabels(value)
+	if len(settings) == 0 {
+		return nil, nil
+	}
+
+	concurrencyLimit = &ConcurrencyLimit{
+		JobType: jobType,
+		Lease:   DEFAULT_LEASE_DURATION,
+		Mode:    CONCURRENCY_MODE_EXIT,
+	}
+
+	for key, value := range settings {
+		switch key {
+		case "limit":
+			if concurrencyLimit.Limit, err = strconv.Atoi(value); err != nil || concurrencyLimit.Limit < 1 {
+				return nil, fmt.Errorf("Invalid Concurrency limit %s For %s", value, jobType)
+			}
+
+		case "lease":
+			if concurrencyLimit.Lease, err = time.ParseDuration(value); err != nil || concurrencyLimit.Lease <= 0 {
+				return nil, fmt.Errorf("Invalid Concurrency lease %s For %s", value, jobType)
+			}
+
+		case "mode":
+			switch value {
+			case CONCURRENCY_MODE_EXIT, CONCURRENCY_MODE_WAIT, CONCURRENCY_MODE_QUEUE:
+				concurrencyLimit.Mode = value
+			default:
+				return nil, fmt.Errorf("Invalid Concurrency mode %s For %s", value, jobType)
+			}
+
+		case "wait":
+			if concurrencyLimit.Wait, err = time.ParseDuration(value); err != nil || concurrencyLimit.Wait < 0 {
+				return nil, fmt.Errorf("Invalid Concurrency wait %s For %s", value, jobType)
+			}
+
+		default:
+			return nil, fmt.Errorf("Unknown Concurrency Setting %s For %s", key, jobType)
+		}
+	}
+
+	if concurrencyLimit.Limit == 0 {
+		return nil, fmt.Errorf("Concurrency limit Missing For %s", jobType)
+	}
+
+	return concurrencyLimit, nil
+}
+
+// acquireJobLease takes a concurrency slot for a job that is about to start, see waitForLeaseSlot
+func acquireJobLease(goRoutine string, useSession string, mongoSession *mgo.Session, useDatabase string, job *Job) (err error) {
+	concurrencyLimit, err := LoadConcurrencyLimit(job.Type)
+	if err != nil || concurrencyLimit == nil {
+		return err
+	}
+
+	// Access the leases collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, LEASES_COLLECTION)
+	if err != nil {
+		return err
+	}
+
+	return waitForLeaseSlot(goRoutine, useSession, useDatabase, collection, concurrencyLimit, job)
+}
+
+// waitForLeaseSlot takes a slot in the leases collection. When no slot is free the wait mode
+// polls until one is, giving up after the wait, the program timeout or StopWaiting, and the
+// queue mode returns ErrJobQueued. ErrConcurrencyLimit is returned for the caller to record.
+func waitForLeaseSlot(goRoutine string, useSession string, useDatabase string, collection *mgo.Collection, concurrencyLimit *ConcurrencyLimit, job *Job) (err error) {
+	// Never wait past the program timeout
+	wait := concurrencyLimit.Wait
+	if wait == 0 {
+		wait = DEFAULT_CONCURRENCY_WAIT
+	}
+
+	if timeout := time.Duration(helper.TimeoutSeconds) * time.Second; timeout > 0 && timeout < wait {
+		wait = timeout
+	}
+
+	deadline := time.Now().Add(wait)
+
+	for {
+		acquired, err := takeLeaseSlot(goRoutine, collection, concurrencyLimit, job)
+		if err != nil {
+			return err
+		}
+
+		if acquired {
+			renewJobLease(goRoutine, useSession, useDatabase, concurrencyLimit, job)
+			return nil
+		}
+
+		if concurrencyLimit.Mode == CONCURRENCY_MODE_QUEUE {
+			return ErrJobQueued
+		}
+
+		if concurrencyLimit.Mode != CONCURRENCY_MODE_WAIT || !time.Now().Before(deadline) {
+			return ErrConcurrencyLimit
+		}
+
+		tracelog.Trace(goRoutine, "acquireJobLease", "Info : Waiting For Slot : JobType[%s] Limit[%d]", job.Type, concurrencyLimit.Limit)
+
+		select {
+		case <-time.After(CONCURRENCY_POLL_INTERVAL):
+		case <-waitShutdown:
+			tracelog.Trace(goRoutine, "acquireJobLease", "Info : Stopped Waiting For Slot : JobType[%s]", job.Type)
+			return ErrConcurrencyLimit
+		}
+	}
+}
+
+// claimJobLease takes a concurrency slot for a pending job that ClaimJob just marked running.
+// Claimed jobs never wait, the job is put back as the previous pending job and ErrConcurrencyLimit
+// is returned.
+func claimJobLease(goRoutine string, useSession string, mongoSession *mgo.Session, useDatabase string, jobs *mgo.Collection, job *Job, previous *Job) (err error) {
+	concurrencyLimit, err := LoadConcurrencyLimit(job.Type)
+	if err != nil || concurrencyLimit == nil {
+		return err
+	}
+
+	// Access the leases collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, LEASES_COLLECTION)
+	if err != nil {
+		return err
+	}
+
+	acquired, err := takeLeaseSlot(goRoutine, collection, concurrencyLimit, job)
+	if err != nil || !acquired {
+		if resetErr := resetClaimedJob(goRoutine, jobs, previous); resetErr != nil {
+			tracelog.Error(resetErr, goRoutine, "claimJobLease")
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return ErrConcurrencyLimit
+	}
+
+	renewJobLease(goRoutine, useSession, useDatabase, concurrencyLimit, job)
+	return nil
+}
+
+// resetClaimedJob puts a claimed job back to pending with the start date and host it had before
+// the claim
+func resetClaimedJob(goRoutine string, jobs *mgo.Collection, previous *Job) (err error) {
+	set := bson.M{"status": JOB_STATUS_PENDING, "start_date": previous.StartDate}
+	update := bson.M{"$set": set}
+	if previous.Host != nil {
+		set["host"] = previous.Host
+	} else {
+		update["$unset"] = bson.M{"host": 1}
+	}
+
+	return mongo.Measure(goRoutine, jobs, "ResetClaimedJob", bson.M{"_id": previous.ObjectId}, func() error {
+		return jobs.UpdateId(previous.ObjectId, update)
+	})
+}
+
+// takeLeaseSlot claims the first slot that is free or whose holder stopped renewing it
+func takeLeaseSlot(goRoutine string, collection *mgo.Collection, concurrencyLimit *ConcurrencyLimit, job *Job) (acquired bool, err error) {
+	for slot := 0; slot < concurrencyLimit.Limit; slot++ {
+		leaseSlot := &JobLease{
+			Id:      fmt.Sprintf("%s:%d", job.Type, slot),
+			Type:    job.Type,
+			JobId:   job.ObjectId,
+			Host:    CurrentHost().Hostname,
+			Expires: time.Now().Add(concurrencyLimit.Lease),
+		}
+
+		// A free slot has no document
+		err = mongo.Measure(goRoutine, collection, "TakeLease", nil, func() error {
+			return collection.Insert(leaseSlot)
+		})
+		if err == nil {
+			job.lease = &jobLease{id: leaseSlot.Id, shutdown: make(chan struct{})}
+			return true, nil
+		}
+
+		if !mgo.IsDup(err) {
+			return false, err
+		}
+
+		// Take over a slot whose lease expired
+		query := bson.M{"_id": leaseSlot.Id, "expires": bson.M{"$lt": time.Now()}}
+
+		err = mongo.Measure(goRoutine, collection, "TakeExpiredLease", query, func() error {
+			return collection.Update(query, leaseSlot)
+		})
+		if err == nil {
+			job.lease = &jobLease{id: leaseSlot.Id, shutdown: make(chan struct{})}
+			return true, nil
+		}
+
+		if err != mgo.ErrNotFound {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// renewJobLease extends the job's slot until the job ends so other hosts know it is still running
+func renewJobLease(goRoutine string, useSession string, useDatabase string, concurrencyLimit *ConcurrencyLimit, job *Job) {
+	lease := job.lease
+
+	go func() {
+		ticker := time.NewTicker(concurrencyLimit.Lease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := updateJobLease(goRoutine, useSession, useDatabase, lease.id, job.ObjectId, bson.M{"$set": bson.M{"expires": time.Now().Add(concurrencyLimit.Lease)}})
+				if err == mgo.ErrNotFound {
+					atomic.StoreInt32(&lease.lost, 1)
+					tracelog.Alert(helper.EmailAlertSubject, goRoutine, "renewJobLease", "Concurrency Lease Lost, Job Over The Limit : Id[%v] JobType[%s] Slot[%s]", job.ObjectId, job.Type, lease.id)
+					return
+				}
+
+				if err != nil {
+					tracelog.Error(err, goRoutine, "renewJobLease")
+				}
+
+			case <-lease.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// releaseJobLease frees the job's slot so a waiting or queued job can run
+func releaseJobLease(goRoutine string, useSession string, useDatabase string, job *Job) {
+	if job.lease == nil {
+		return
+	}
+
+	job.lease.stop()
+
+	if err := updateJobLease(goRoutine, useSession, useDatabase, job.lease.id, job.ObjectId, nil); err != nil && err != mgo.ErrNotFound {
+		tracelog.Error(err, goRoutine, "releaseJobLease")
+	}
+
+	job.lease = nil
+}
+
+// updateJobLease updates the slot if the job still holds it, or removes it when update is nil
+func updateJobLease(goRoutine string, useSession string, useDatabase string, leaseId string, jobId bson.ObjectId, update bson.M) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "updateJobLease")
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		return err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the leases collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, LEASES_COLLECTION)
+	if err != nil {
+		return err
+	}
+
+	query := bson.M{"_id": leaseId, "job_id": jobId}
+
+	if update == nil {
+		return mongo.Measure(goRoutine, collection, "ReleaseLease", query, func() error {
+			return collection.Remove(query)
+		})
+	}
+
+	return mongo.Measure(goRoutine, collection, "RenewLease", query, func() error {
+		return collection.Update(query, update)
+	})
+}
@@ -0,0 +1,165 @@
+package data
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//** TESTS
+
+// TestParseConcurrencyLimit checks the settings, their defaults and the modes
+func TestParseConcurrencyLimit(t *testing.T) {
+	tests := []struct {
+		value            string
+		concurrencyLimit *ConcurrencyLimit
+		message          string // Expected error text, none when empty
+	}{
+		{"", nil, ""},
+		{"limit=2", &ConcurrencyLimit{JobType: "nightly", Limit: 2, Lease: DEFAULT_LEASE_DURATION, Mode: CONCURRENCY_MODE_EXIT}, ""},
+		{"limit=1,mode=wait,wait=10m", &ConcurrencyLimit{JobType: "nightly", Limit: 1, Lease: DEFAULT_LEASE_DURATION, Mode: CONCURRENCY_MODE_WAIT, Wait: 10 * time.Minute}, ""},
+		{"limit=1,mode=queue,lease=30s", &ConcurrencyLimit{JobType: "nightly", Limit: 1, Lease: 30 * time.Second, Mode: CONCURRENCY_MODE_QUEUE}, ""},
+		{"limit=1,mode=exit", &ConcurrencyLimit{JobType: "nightly", Limit: 1, Lease: DEFAULT_LEASE_DURATION, Mode: CONCURRENCY_MODE_EXIT}, ""},
+		{"limit=1,mode=later", nil, "Invalid Concurrency mode later"},
+		{"limit=0", nil, "Invalid Concurrency limit 0"},
+		{"limit=1,lease=0s", nil, "Invalid Concurrency lease 0s"},
+		{"limit=1,wait=soon", nil, "Invalid Concurrency wait soon"},
+		{"limit=1,slots=2", nil, "Unknown Concurrency Setting slots"},
+		{"mode=wait", nil, "Concurrency limit Missing"},
+	}
+
+	for _, test := range tests {
+		concurrencyLimit, err := parseConcurrencyLimit("nightly", test.value)
+
+		if test.message != "" {
+			if err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Errorf("%q : Expected an error containing %q, got %v", test.value, test.message, err)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(concurrencyLimit, test.concurrencyLimit) {
+			t.Errorf("%q : Expected %+v, got %+v %v", test.value, test.concurrencyLimit, concurrencyLimit, err)
+		}
+	}
+}
+
+// TestWaitForLeaseSlot checks each mode takes a free or expired slot, and what each does when
+// the slot is held
+func TestWaitForLeaseSlot(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		holder   time.Duration // When the lease held by another job expires, none when zero
+		expected error
+	}{
+		{"exit free", CONCURRENCY_MODE_EXIT, 0, nil},
+		{"wait free", CONCURRENCY_MODE_WAIT, 0, nil},
+		{"queue free", CONCURRENCY_MODE_QUEUE, 0, nil},
+		{"exit expired", CONCURRENCY_MODE_EXIT, -time.Minute, nil},
+		{"queue expired", CONCURRENCY_MODE_QUEUE, -time.Minute, nil},
+		{"exit held", CONCURRENCY_MODE_EXIT, time.Hour, ErrConcurrencyLimit},
+		{"wait held", CONCURRENCY_MODE_WAIT, time.Hour, ErrConcurrencyLimit},
+		{"queue held", CONCURRENCY_MODE_QUEUE, time.Hour, ErrJobQueued},
+	}
+
+	server := startFakeJobs(t)
+	defer server.close()
+
+	mongoSession, err := mgo.DialWithTimeout(server.listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to dial the fake server : %s", err)
+	}
+	defer mongoSession.Close()
+
+	collection := mongoSession.DB("test").C(LEASES_COLLECTION)
+
+	for _, test := range tests {
+		jobType := strings.Replace(test.name, " ", "-", -1)
+		slot := jobType + ":0"
+
+		if test.holder != 0 {
+			server.insert(LEASES_COLLECTION, &JobLease{Id: slot, Type: jobType, JobId: bson.NewObjectId(), Expires: time.Now().Add(test.holder)})
+		}
+
+		// The wait ends straight away so a held slot is not polled
+		concurrencyLimit := &ConcurrencyLimit{JobType: jobType, Limit: 1, Lease: time.Minute, Mode: test.mode, Wait: time.Nanosecond}
+		job := &Job{ObjectId: bson.NewObjectId(), Type: jobType}
+
+		err := waitForLeaseSlot("test", "TestWaitForLeaseSlot", "test", collection, concurrencyLimit, job)
+		if err != test.expected {
+			t.Errorf("%s : Expected %v, got %v", test.name, test.expected, err)
+			continue
+		}
+
+		if test.expected != nil {
+			if job.lease != nil {
+				t.Errorf("%s : Expected no lease", test.name)
+			}
+			continue
+		}
+
+		if job.lease == nil || job.lease.id != slot || server.find(LEASES_COLLECTION, slot)["job_id"] != job.ObjectId {
+			t.Errorf("%s : Expected the job to hold %s, got %v", test.name, slot, server.find(LEASES_COLLECTION, slot))
+		}
+
+		if job.lease != nil {
+			job.lease.stop()
+		}
+	}
+}
+
+// TestResetClaimedJob checks a job that could not take a slot gets back the start date and host
+// it had while pending
+func TestResetClaimedJob(t *testing.T) {
+	queued := time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC)
+	host := &JobHost{Hostname: "worker-1", PID: 42}
+
+	tests := []struct {
+		name     string
+		previous *Job
+	}{
+		{"with host", &Job{ObjectId: bson.NewObjectId(), StartDate: queued, Host: host}},
+		{"without host", &Job{ObjectId: bson.NewObjectId(), StartDate: queued}},
+	}
+
+	server := startFakeJobs(t)
+	defer server.close()
+
+	mongoSession, err := mgo.DialWithTimeout(server.listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to dial the fake server : %s", err)
+	}
+	defer mongoSession.Close()
+
+	collection := mongoSession.DB("test").C(JOBS_COLLECTION)
+
+	for _, test := range tests {
+		// The job as the claim left it
+		server.insert(JOBS_COLLECTION, &Job{ObjectId: test.previous.ObjectId, Status: JOB_STATUS_RUNNING, StartDate: time.Now(), Host: CurrentHost()})
+
+		if err := resetClaimedJob("test", collection, test.previous); err != nil {
+			t.Errorf("%s : Unable to reset the job : %s", test.name, err)
+			continue
+		}
+
+		document := server.find(JOBS_COLLECTION, test.previous.ObjectId)
+
+		startDate, _ := document["start_date"].(time.Time)
+		if document["status"] != JOB_STATUS_PENDING || !startDate.Equal(queued) {
+			t.Errorf("%s : Expected a pending job started at %v, got %v", test.name, queued, document)
+		}
+
+		stored, hasHost := document["host"].(bson.M)
+		if test.previous.Host == nil && hasHost {
+			t.Errorf("%s : Expected no host, got %v", test.name, stored)
+		}
+
+		if test.previous.Host != nil && (stored["hostname"] != host.Hostname || stored["pid"] != host.PID) {
+			t.Errorf("%s : Expected host %+v, got %v", test.name, host, stored)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package data
+
+import (
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	DEFAULT_DETAIL_BATCH_SIZE     = 500
+	DEFAULT_DETAIL_FLUSH_INTERVAL = 5 * time.Second
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	detailWriters      = map[*DetailWriter]bool{} // Writers that have not been closed
+	detailWritersMutex sync.Mutex                 // Protects the detailWriters map
+)
+
+//** TYPES
+
+type (
+	// DetailWriter buffers job details in memory and writes them to the
+	// job document in batches from a background goroutine
+	DetailWriter struct {
+		goRoutine   string
+		useSession  string
+		useDatabase string
+		job         *Job
+		batchSize   int
+		interval    time.Duration
+
+		mutex    sync.Mutex
+		pending  []JobDetail
+		closed   bool
+		wake     chan struct{}
+		flush    chan chan error
+		shutdown chan chan error
+		done     chan struct{}
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// NewDetailWriter creates a writer for the specified job and starts its flush goroutine.
+// Details are written when batchSize details are pending or every interval, whichever comes first.
+// EndJob and FailJob close the job's writer so pending details are always written.
+func NewDetailWriter(goRoutine string, useSession string, useDatabase string, job *Job, batchSize int, interval time.Duration) *DetailWriter {
+	tracelog.Startedf(goRoutine, "NewDetailWriter", "UseSession[%s] UseDatabase[%s] Id[%v] BatchSize[%d] Interval[%v]", useSession, useDatabase, job.ObjectId, batchSize, interval)
+
+	if batchSize <= 0 {
+		batchSize = DEFAULT_DETAIL_BATCH_SIZE
+	}
+
+	if interval <= 0 {
+		interval = DEFAULT_DETAIL_FLUSH_INTERVAL
+	}
+
+	detailWriter := &DetailWriter{
+		goRoutine:   goRoutine,
+		useSession:  useSession,
+		useDatabase: useDatabase,
+		job:         job,
+		batchSize:   batchSize,
+		interval:    interval,
+		wake:        make(chan struct{}, 1),
+		flush:       make(chan chan error),
+		shutdown:    make(chan chan error),
+		done:        make(chan struct{}),
+	}
+
+	// Tie the writer to the job so ending the job flushes it
+	job.detailWriter = detailWriter
+
+	detailWritersMutex.Lock()
+	detailWriters[detailWriter] = true
+	detailWritersMutex.Unlock()
+
+	go detailWriter.run()
+
+	tracelog.Completed(goRoutine, "NewDetailWriter")
+	return detailWriter
+}
+
+// FlushDetailWriters flushes and closes every open detail writer. The controller calls
+// this during shutdown so buffered details are not lost.
+func FlushDetailWriters(goRoutine string) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "FlushDetailWriters")
+
+	tracelog.Started(goRoutine, "FlushDetailWriters")
+
+	detailWritersMutex.Lock()
+	writers := make([]*DetailWriter, 0, len(detailWriters))
+	for detailWriter := range detailWriters {
+		writers = append(writers, detailWriter)
+	}
+	detailWritersMutex.Unlock()
+
+	for _, detailWriter := range writers {
+		if closeErr := detailWriter.Close(); closeErr != nil {
+			tracelog.Error(closeErr, goRoutine, "FlushDetailWriters")
+			err = closeErr
+		}
+	}
+
+	tracelog.Completed(goRoutine, "FlushDetailWriters")
+	return err
+}
+
+//** MEMBER FUNCTIONS
+
+// Add queues a job detail to be written with the next batch
+func (detailWriter *DetailWriter) Add(task string, details string) {
+	detailWriter.mutex.Lock()
+
+	if detailWriter.closed {
+		detailWriter.mutex.Unlock()
+		tracelog.Warning(detailWriter.goRoutine, "DetailWriter.Add", "Writer Closed : Id[%v] Task[%s]", detailWriter.job.ObjectId, task)
+		return
+	}
+
+	detailWriter.pending = append(detailWriter.pending, JobDetail{
+		Task:    task,
+		Date:    time.Now(),
+		Details: details,
+	})
+
+	full := len(detailWriter.pending) >= detailWriter.batchSize
+	detailWriter.mutex.Unlock()
+
+	// Wake the flush goroutine without blocking the caller
+	if full {
+		select {
+		case detailWriter.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush writes all pending details and waits for the write to complete
+func (detailWriter *DetailWriter) Flush() (err error) {
+	result := make(chan error)
+
+	select {
+	case detailWriter.flush <- result:
+		return <-result
+
+	case <-detailWriter.done:
+		// The writer is closed and everything has been written
+		return err
+	}
+}
+
+// Close writes all pending details and stops the flush goroutine. It is safe to call more than once.
+func (detailWriter *DetailWriter) Close() (err error) {
+	detailWriter.mutex.Lock()
+
+	if detailWriter.closed {
+		detailWriter.mutex.Unlock()
+		return err
+	}
+
+	detailWriter.closed = true
+	detailWriter.mutex.Unlock()
+
+	detailWritersMutex.Lock()
+	delete(detailWriters, detailWriter)
+	detailWritersMutex.Unlock()
+
+	result := make(chan error)
+
+	select {
+	case detailWriter.shutdown <- result:
+		return <-result
+
+	case <-detailWriter.done:
+		return err
+	}
+}
+
+// run is the flush goroutine for the writer
+func (detailWriter *DetailWriter) run() {
+	ticker := time.NewTicker(detailWriter.interval)
+	defer ticker.Stop()
+	defer close(detailWriter.done)
+
+	for {
+		select {
+		case <-ticker.C:
+			detailWriter.write()
+
+		case <-detailWriter.wake:
+			detailWriter.write()
+
+		case result := <-detailWriter.flush:
+			result <- detailWriter.write()
+
+		case result := <-detailWriter.shutdown:
+			result <- detailWriter.write()
+			return
+		}
+	}
+}
+
+// write takes the pending details and adds them to the job document with a single update
+func (detailWriter *DetailWriter) write() (err error) {
+	defer helper.CatchPanic(&err, detailWriter.goRoutine, "DetailWriter.write")
+
+	detailWriter.mutex.Lock()
+	details := detailWriter.pending
+	detailWriter.pending = nil
+	detailWriter.mutex.Unlock()
+
+	if len(details) == 0 {
+		return err
+	}
+
+	tracelog.Startedf(detailWriter.goRoutine, "DetailWriter.write", "UseDatabase[%s] Id[%v] Details[%d]", detailWriter.useDatabase, detailWriter.job.ObjectId, len(details))
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(detailWriter.goRoutine, detailWriter.useSession)
+	if err != nil {
+		detailWriter.requeue(details)
+		tracelog.CompletedError(err, detailWriter.goRoutine, "DetailWriter.write")
+		return err
+	}
+
+	defer mongo.CloseSession(detailWriter.goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, detailWriter.useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		detailWriter.requeue(details)
+		tracelog.CompletedError(err, detailWriter.goRoutine, "DetailWriter.write")
+		return err
+	}
+
+	// Create the update document
+	update := bson.M{"$addToSet": bson.M{"details": bson.M{"$each": details}}}
+
+	// Update the job
+	err = mongo.Measure(detailWriter.goRoutine, collection, "AddJobDetails", bson.M{"_id": detailWriter.job.ObjectId}, func() (err error) {
+		_, err = collection.UpsertId(detailWriter.job.ObjectId, update)
+		return err
+	})
+	if err != nil {
+		detailWriter.requeue(details)
+		tracelog.CompletedError(err, detailWriter.goRoutine, "DetailWriter.write")
+		return err
+	}
+
+	tracelog.Completed(detailWriter.goRoutine, "DetailWriter.write")
+	return err
+}
+
+// requeue puts details that failed to write back in front of the pending details
+func (detailWriter *DetailWriter) requeue(details []JobDetail) {
+	detailWriter.mutex.Lock()
+	detailWriter.pending = append(details, detailWriter.pending...)
+	detailWriter.mutex.Unlock()
+}
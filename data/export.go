@@ -0,0 +1,566 @@
+package data
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	EXPORT_FORMAT_JSONL = "jsonl"
+	EXPORT_FORMAT_CSV   = "csv"
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// exportColumns are the csv columns. Each row is one detail of a job with the
+	// job columns repeated, a job without details is written as a single row. Labels,
+	// notes and host are kept as JSON so any value survives a round trip.
+	exportColumns = []string{
+		"job_id",
+		"type",
+		"status",
+		"start_date",
+		"end_date",
+		"duration_seconds",
+		"result",
+		"idempotency_key",
+		"labels",
+		"acknowledged_by",
+		"notes",
+		"host",
+		"detail_task",
+		"detail_date",
+		"detail_details",
+	}
+)
+
+//** TYPES
+
+type (
+	// exportRecord is a job as written to a JSON Lines archive
+	exportRecord struct {
+		Id              string         `json:"job_id"`
+		Type            string         `json:"type"`
+		Status          string         `json:"status"`
+		StartDate       time.Time      `json:"start_date"`
+		EndDate         *time.Time     `json:"end_date,omitempty"`
+		DurationSeconds float64        `json:"duration_seconds"`
+		Result          string         `json:"result,omitempty"`
+		IdempotencyKey  string         `json:"idempotency_key,omitempty"`
+		Labels          Labels         `json:"labels,omitempty"`
+		AcknowledgedBy  string         `json:"acknowledged_by,omitempty"`
+		Notes           []exportNote   `json:"notes,omitempty"`
+		Host            *JobHost       `json:"host,omitempty"`
+		Details         []exportDetail `json:"details"`
+	}
+
+	// exportNote is an operator note as written to an archive
+	exportNote struct {
+		Author      string    `json:"author"`
+		Date        time.Time `json:"date"`
+		Text        string    `json:"text"`
+		Acknowledge bool      `json:"acknowledge,omitempty"`
+	}
+
+	// exportDetail is a job detail as written to a JSON Lines archive
+	exportDetail struct {
+		Task    string    `json:"task"`
+		Date    time.Time `json:"date"`
+		Details string    `json:"details"`
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// ExportJobs streams the jobs matching the filter to the writer in the specified format
+func ExportJobs(goRoutine string, useSession string, useDatabase string, jobFilter *JobFilter, format string, writer io.Writer) (count int, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "ExportJobs")
+
+	query := jobFilter.Query()
+
+	tracelog.Startedf(goRoutine, "ExportJobs", "UseSession[%s] UseDatabase[%s] Format[%s] Query[%s]", useSession, useDatabase, format, mongo.ToString(query))
+
+	if format != EXPORT_FORMAT_JSONL && format != EXPORT_FORMAT_CSV {
+		err = fmt.Errorf("Unknown Export Format %s", format)
+		tracelog.CompletedError(err, goRoutine, "ExportJobs")
+		return count, err
+	}
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ExportJobs")
+		return count, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ExportJobs")
+		return count, err
+	}
+
+	buffer := bufio.NewWriter(writer)
+	csvWriter := csv.NewWriter(buffer)
+	jsonEncoder := json.NewEncoder(buffer)
+
+	if format == EXPORT_FORMAT_CSV {
+		if err = csvWriter.Write(exportColumns); err != nil {
+			tracelog.CompletedError(err, goRoutine, "ExportJobs")
+			return count, err
+		}
+	}
+
+	// Stream the jobs in start order, timing only the reads for the metrics
+	iter := collection.Find(query).Sort("start_date").Iter()
+
+	var reading time.Duration
+	var job Job
+	for {
+		started := time.Now()
+		more := iter.Next(&job)
+		reading += time.Since(started)
+
+		if !more {
+			break
+		}
+
+		record := newExportRecord(&job)
+
+		switch format {
+		case EXPORT_FORMAT_JSONL:
+			err = jsonEncoder.Encode(record)
+
+		case EXPORT_FORMAT_CSV:
+			err = csvWriter.WriteAll(record.rows())
+		}
+
+		if err != nil {
+			iter.Close()
+			tracelog.CompletedError(err, goRoutine, "ExportJobs")
+			return count, err
+		}
+
+		count++
+		job = Job{}
+	}
+
+	err = iter.Close()
+	mongo.Observe(goRoutine, collection.Name, "ExportJobs", query, reading, err)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ExportJobs")
+		return count, err
+	}
+
+	csvWriter.Flush()
+	if err = buffer.Flush(); err != nil {
+		tracelog.CompletedError(err, goRoutine, "ExportJobs")
+		return count, err
+	}
+
+	tracelog.Completedf(goRoutine, "ExportJobs", "Count[%d]", count)
+	return count, err
+}
+
+// ImportJobs loads jobs from an archive written by ExportJobs. Jobs that already exist
+// are skipped unless overwrite is set, which replaces only the fields the archive carries
+// so the priority, workflow, checkpoint and other live state are kept. Idempotency keys
+// are imported as released keys so archived jobs never block or collide with live ones.
+func ImportJobs(goRoutine string, useSession string, useDatabase string, format string, overwrite bool, reader io.Reader) (count int, skipped int, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "ImportJobs")
+
+	tracelog.Startedf(goRoutine, "ImportJobs", "UseSession[%s] UseDatabase[%s] Format[%s] Overwrite[%v]", useSession, useDatabase, format, overwrite)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ImportJobs")
+		return count, skipped, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ImportJobs")
+		return count, skipped, err
+	}
+
+	save := func(record *exportRecord) error {
+		job, err := record.job()
+		if err != nil {
+			return err
+		}
+
+		update := bson.M{"$setOnInsert": importDocument(job)}
+		if overwrite {
+			update = bson.M{"$set": importDocument(job)}
+		}
+
+		var changeInfo *mgo.ChangeInfo
+		err = mongo.Measure(goRoutine, collection, "ImportJobs", bson.M{"_id": job.ObjectId}, func() (err error) {
+			changeInfo, err = collection.UpsertId(job.ObjectId, update)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if !overwrite && changeInfo.UpsertedId == nil {
+			skipped++
+			return nil
+		}
+
+		count++
+		return nil
+	}
+
+	switch format {
+	case EXPORT_FORMAT_JSONL:
+		err = importJSONLines(reader, save)
+
+	case EXPORT_FORMAT_CSV:
+		err = importCSV(reader, save)
+
+	default:
+		err = fmt.Errorf("Unknown Import Format %s", format)
+	}
+
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ImportJobs")
+		return count, skipped, err
+	}
+
+	tracelog.Completedf(goRoutine, "ImportJobs", "Count[%d] Skipped[%d]", count, skipped)
+	return count, skipped, err
+}
+
+//** MEMBER FUNCTIONS
+
+// rows returns the csv rows for the record
+func (record *exportRecord) rows() [][]string {
+	endDate := ""
+	if record.EndDate != nil {
+		endDate = record.EndDate.Format(time.RFC3339Nano)
+	}
+
+	columns := []string{
+		record.Id,
+		record.Type,
+		record.Status,
+		record.StartDate.Format(time.RFC3339Nano),
+		endDate,
+		strconv.FormatFloat(record.DurationSeconds, 'f', 3, 64),
+		record.Result,
+		record.IdempotencyKey,
+		"",
+		record.AcknowledgedBy,
+		"",
+		"",
+	}
+
+	// Free text is kept as JSON in a single column
+	if len(record.Labels) > 0 {
+		labels, _ := json.Marshal(record.Labels)
+		columns[8] = string(labels)
+	}
+
+	if len(record.Notes) > 0 {
+		notes, _ := json.Marshal(record.Notes)
+		columns[10] = string(notes)
+	}
+
+	if record.Host != nil {
+		host, _ := json.Marshal(record.Host)
+		columns[11] = string(host)
+	}
+
+	if len(record.Details) == 0 {
+		return [][]string{append(columns, "", "", "")}
+	}
+
+	rows := make([][]string, 0, len(record.Details))
+	for _, detail := range record.Details {
+		row := append(append([]string{}, columns...), detail.Task, detail.Date.Format(time.RFC3339Nano), detail.Details)
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// job converts an imported record back to a job document
+func (record *exportRecord) job() (*Job, error) {
+	if !bson.IsObjectIdHex(record.Id) {
+		return nil, fmt.Errorf("Invalid Job Id %s", record.Id)
+	}
+
+	job := &Job{
+		ObjectId:      bson.ObjectIdHex(record.Id),
+		SchemaVersion: JOB_SCHEMA_VERSION,
+		Type:          record.Type,
+		ReleasedKey:   record.IdempotencyKey,
+		Labels:        record.Labels,
+		LabelIndex:    record.Labels.index(),
+		Host:          record.Host,
+		Status:        record.Status,
+		StartDate:     record.StartDate,
+		Result:        record.Result,
+		Details:       make([]JobDetail, 0, len(record.Details)),
+	}
+
+	if record.EndDate != nil {
+		job.EndDate = *record.EndDate
+	}
+
+	for _, note := range record.Notes {
+		job.Notes = append(job.Notes, JobNote{Author: note.Author, Date: note.Date, Text: note.Text, Acknowledge: note.Acknowledge})
+
+		if note.Acknowledge {
+			job.Acknowledgement = &JobAcknowledgement{Author: note.Author, Date: note.Date, Text: note.Text}
+		}
+	}
+
+	// Inherited acknowledgements have no note of their own
+	if job.Acknowledgement == nil && record.AcknowledgedBy != "" {
+		job.Acknowledgement = &JobAcknowledgement{Author: record.AcknowledgedBy}
+	}
+
+	for _, detail := range record.Details {
+		job.Details = append(job.Details, JobDetail{Task: detail.Task, Date: detail.Date, Details: detail.Details})
+	}
+
+	return job, nil
+}
+
+//** PRIVATE FUNCTIONS
+
+// newExportRecord flattens a job for export
+func newExportRecord(job *Job) *exportRecord {
+	record := &exportRecord{
+		Id:             job.ObjectId.Hex(),
+		Type:           job.Type,
+		Status:         job.Status,
+		StartDate:      job.StartDate,
+		Result:         job.Result,
+		IdempotencyKey: job.IdempotencyKey,
+		Labels:         job.Labels,
+		Details:        make([]exportDetail, 0, len(job.Details)),
+	}
+
+	// Keep the key of a job that already gave it up
+	if record.IdempotencyKey == "" {
+		record.IdempotencyKey = job.ReleasedKey
+	}
+
+	if !job.EndDate.IsZero() {
+		endDate := job.EndDate
+		record.EndDate = &endDate
+		record.DurationSeconds = job.EndDate.Sub(job.StartDate).Seconds()
+	}
+
+	if job.Acknowledgement != nil {
+		record.AcknowledgedBy = job.Acknowledgement.Author
+	}
+
+	record.Host = job.Host
+
+	for _, note := range job.Notes {
+		record.Notes = append(record.Notes, exportNote{Author: note.Author, Date: note.Date, Text: note.Text, Acknowledge: note.Acknowledge})
+	}
+
+	for _, detail := range job.Details {
+		record.Details = append(record.Details, exportDetail{Task: detail.Task, Date: detail.Date, Details: detail.Details})
+	}
+
+	return record
+}
+
+// importDocument returns the fields of an imported job that the archive carries. Fields
+// it does not carry, such as the priority and workflow, are left out so an overwrite
+// never clears them.
+func importDocument(job *Job) bson.M {
+	document := bson.M{
+		"schema_version": job.SchemaVersion,
+		"type":           job.Type,
+		"status":         job.Status,
+		"start_date":     job.StartDate,
+		"details":        job.Details,
+	}
+
+	if job.ReleasedKey != "" {
+		document["released_key"] = job.ReleasedKey
+	}
+
+	if len(job.Labels) > 0 {
+		document["labels"] = job.Labels
+		document["label_index"] = job.LabelIndex
+	}
+
+	if !job.EndDate.IsZero() {
+		document["end_date"] = job.EndDate
+	}
+
+	if job.Result != "" {
+		document["result"] = job.Result
+	}
+
+	if job.Host != nil {
+		document["host"] = job.Host
+	}
+
+	if len(job.Notes) > 0 {
+		document["notes"] = job.Notes
+	}
+
+	if job.Acknowledgement != nil {
+		document["acknowledgement"] = job.Acknowledgement
+	}
+
+	return document
+}
+
+// importJSONLines decodes one record per line
+func importJSONLines(reader io.Reader, save func(*exportRecord) error) error {
+	decoder := json.NewDecoder(reader)
+
+	for {
+		var record exportRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = save(&record); err != nil {
+			return err
+		}
+	}
+}
+
+// importCSV groups consecutive rows for the same job back into a record
+func importCSV(reader io.Reader, save func(*exportRecord) error) error {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = len(exportColumns)
+
+	// Archives from older versions have different columns
+	header, err := csvReader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	if strings.Join(header, ",") != strings.Join(exportColumns, ",") {
+		return fmt.Errorf("Unsupported CSV Columns %s", strings.Join(header, ","))
+	}
+
+	var record *exportRecord
+
+	for {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if record == nil || record.Id != row[0] {
+			if record != nil {
+				if err = save(record); err != nil {
+					return err
+				}
+			}
+
+			if record, err = parseCSVJob(row); err != nil {
+				return err
+			}
+		}
+
+		// A job without details has empty detail columns
+		if row[12] == "" && row[13] == "" && row[14] == "" {
+			continue
+		}
+
+		detailDate, err := time.Parse(time.RFC3339Nano, row[13])
+		if err != nil {
+			return err
+		}
+
+		record.Details = append(record.Details, exportDetail{Task: row[12], Date: detailDate, Details: row[14]})
+	}
+
+	if record != nil {
+		return save(record)
+	}
+
+	return nil
+}
+
+// parseCSVJob reads the job columns of a csv row
+func parseCSVJob(row []string) (*exportRecord, error) {
+	startDate, err := time.Parse(time.RFC3339Nano, row[3])
+	if err != nil {
+		return nil, err
+	}
+
+	record := &exportRecord{
+		Id:             row[0],
+		Type:           row[1],
+		Status:         row[2],
+		StartDate:      startDate,
+		Result:         row[6],
+		IdempotencyKey: row[7],
+		AcknowledgedBy: row[9],
+	}
+
+	if row[8] != "" {
+		if err = json.Unmarshal([]byte(row[8]), &record.Labels); err != nil {
+			return nil, err
+		}
+	}
+
+	if row[10] != "" {
+		if err = json.Unmarshal([]byte(row[10]), &record.Notes); err != nil {
+			return nil, err
+		}
+	}
+
+	if row[11] != "" {
+		if err = json.Unmarshal([]byte(row[11]), &record.Host); err != nil {
+			return nil, err
+		}
+	}
+
+	if row[4] != "" {
+		endDate, err := time.Parse(time.RFC3339Nano, row[4])
+		if err != nil {
+			return nil, err
+		}
+		record.EndDate = &endDate
+	}
+
+	return record, nil
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//** TESTS
+
+// TestExportRoundTrip checks a job written to either archive format reads back unchanged
+func TestExportRoundTrip(t *testing.T) {
+	startDate := time.Date(2024, 3, 1, 9, 30, 0, 123000000, time.UTC)
+	endDate := startDate.Add(90 * time.Second)
+
+	tests := []struct {
+		name string
+		job  Job
+	}{
+		{"bare", Job{
+			ObjectId:  bson.NewObjectId(),
+			Type:      "nightly",
+			Status:    JOB_STATUS_RUNNING,
+			StartDate: startDate,
+			Details:   []JobDetail{},
+		}},
+		{"complete", Job{
+			ObjectId:        bson.NewObjectId(),
+			Type:            "nightly",
+			IdempotencyKey:  "nightly-2024-03-01",
+			Labels:          Labels{"customer": "acme", "region": "us, east"},
+			Status:          JOB_STATUS_FAILED,
+			StartDate:       startDate,
+			EndDate:         endDate,
+			Result:          "Failed: \"quoted\", with commas",
+			Host:            &JobHost{Hostname: "worker1", PID: 42},
+			Notes:           []JobNote{{Author: "ops", Date: endDate, Text: "Known issue\nsee ticket", Acknowledge: true}},
+			Acknowledgement: &JobAcknowledgement{Author: "ops", Date: endDate, Text: "Known issue\nsee ticket"},
+			Details: []JobDetail{
+				{Task: "load", Date: startDate, Details: "Loaded 10 rows"},
+				{Task: "save", Date: endDate, Details: "Error, \"disk full\""},
+			},
+		}},
+	}
+
+	for _, test := range tests {
+		expected := test.job
+		expected.SchemaVersion = JOB_SCHEMA_VERSION
+		expected.ReleasedKey = expected.IdempotencyKey
+		expected.IdempotencyKey = ""
+		expected.LabelIndex = expected.Labels.index()
+
+		record := newExportRecord(&test.job)
+
+		var archive bytes.Buffer
+		if err := json.NewEncoder(&archive).Encode(record); err != nil {
+			t.Fatalf("%s : Unable to write the JSON Lines archive : %s", test.name, err)
+		}
+
+		checkImport(t, test.name+" jsonl", expected, func(save func(*exportRecord) error) error {
+			return importJSONLines(&archive, save)
+		})
+
+		archive.Reset()
+		csvWriter := csv.NewWriter(&archive)
+		csvWriter.Write(exportColumns)
+		csvWriter.WriteAll(record.rows())
+
+		checkImport(t, test.name+" csv", expected, func(save func(*exportRecord) error) error {
+			return importCSV(&archive, save)
+		})
+	}
+}
+
+// TestImportDocument checks an import never writes the fields the archive does not carry
+func TestImportDocument(t *testing.T) {
+	job := &Job{
+		ObjectId:   bson.NewObjectId(),
+		Type:       "nightly",
+		Status:     JOB_STATUS_COMPLETED,
+		Priority:   JOB_PRIORITY_NORMAL,
+		QueueDate:  time.Now(),
+		Checkpoint: "step 3",
+		Workflow:   &JobWorkflow{},
+	}
+
+	document := importDocument(job)
+
+	for _, field := range []string{"_id", "priority", "queue_date", "checkpoint", "workflow", "sla_breaches", "preemption", "idempotency_key"} {
+		if _, ok := document[field]; ok {
+			t.Errorf("Expected %s to be left out of the import", field)
+		}
+	}
+
+	for _, field := range []string{"schema_version", "type", "status", "start_date", "details"} {
+		if _, ok := document[field]; !ok {
+			t.Errorf("Expected %s in the import", field)
+		}
+	}
+}
+
+//** PRIVATE FUNCTIONS
+
+// checkImport runs the import and compares the one job it saves with the expected job
+func checkImport(t *testing.T, name string, expected Job, run func(save func(*exportRecord) error) error) {
+	var jobs []*Job
+
+	err := run(func(record *exportRecord) error {
+		job, err := record.job()
+		if err == nil {
+			jobs = append(jobs, job)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("%s : Unable to import : %s", name, err)
+	}
+
+	if len(jobs) != 1 {
+		t.Fatalf("%s : Expected one job, got %d", name, len(jobs))
+	}
+
+	if !reflect.DeepEqual(*jobs[0], expected) {
+		t.Errorf("%s : Expected\n%+v\ngot\n%+v", name, expected, *jobs[0])
+	}
+}
@@ -0,0 +1,18 @@
+package data
+
+import (
+	"github.com/goinggo/task/controller"
+)
+
+//** PRIVATE FUNCTIONS
+
+// init hooks the job store into the controller. Jobs waiting for a concurrency slot give up on an
+// interrupt, and buffered details are written and run summaries sent when the program stops.
+func init() {
+	controller.OnInterrupt(StopWaiting)
+
+	controller.OnShutdown(func() {
+		FlushDetailWriters("main")
+		SendRunSummaries("main")
+	})
+}
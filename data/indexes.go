@@ -0,0 +1,84 @@
+package data
+
+import (
+	"fmt"
+	"github.com/goinggo/task/mongo"
+	"gopkg.in/mgo.v2"
+	"sync"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	// LEASE_RETENTION is how long an expired lease is kept before mongo removes it
+	LEASE_RETENTION = time.Hour
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// idempotencyIndex keeps two jobs from holding the same key. It is sparse so jobs started
+	// without a key do not collide.
+	idempotencyIndex = mgo.Index{Key: []string{"idempotency_key"}, Unique: true, Sparse: true, Background: true}
+
+	idempotencyIndexed      = map[string]bool{} // Session and database pairs known to have idempotencyIndex
+	idempotencyIndexedMutex sync.Mutex          // Protects idempotencyIndexed
+)
+
+//** PRIVATE FUNCTIONS
+
+// init declares the indexes the data collections need, they are created by mongo.Startup
+func init() {
+	mongo.RegisterIndexes(mongo.MASTER_SESSION, "", JOBS_COLLECTION,
+		// Listing jobs by type, newest first
+		mgo.Index{Key: []string{"type", "-start_date"}},
+
+		// Cleaning and exporting jobs by date
+		mgo.Index{Key: []string{"start_date"}},
+
+		// Claiming pending jobs by priority
+		mgo.Index{Key: []string{"status", "type", "-priority"}},
+
+		// Filtering jobs by label
+		mgo.Index{Key: []string{"label_index"}},
+
+		// Keys are checked on every start, see ensureIdempotencyIndex
+		idempotencyIndex,
+	)
+
+	// Expired leases are taken over, the TTL only removes slots nobody uses anymore
+	mongo.RegisterIndexes(mongo.MASTER_SESSION, "", LEASES_COLLECTION,
+		mgo.Index{Key: []string{"expires"}, ExpireAfter: LEASE_RETENTION},
+	)
+
+	// Listing artifacts is always by job
+	mongo.RegisterIndexes(mongo.MASTER_SESSION, "", ARTIFACTS_PREFIX+".files",
+		mgo.Index{Key: []string{"metadata.job_id"}},
+	)
+}
+
+// ensureIdempotencyIndex makes sure the jobs collection has the unique idempotency index before a
+// key is claimed. Startup only creates it in the configured database of the master session, so
+// other databases and sessions created after Startup are covered here. Each session and database
+// pair is checked once.
+func ensureIdempotencyIndex(goRoutine string, useSession string, collection *mgo.Collection) (err error) {
+	indexed := useSession + "/" + collection.Database.Name
+
+	idempotencyIndexedMutex.Lock()
+	defer idempotencyIndexedMutex.Unlock()
+
+	if idempotencyIndexed[indexed] {
+		return nil
+	}
+
+	err = mongo.Measure(goRoutine, collection, "EnsureIdempotencyIndex", nil, func() error {
+		return collection.EnsureIndex(idempotencyIndex)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable To Ensure The Idempotency Index For %s : %s", collection.FullName, err)
+	}
+
+	idempotencyIndexed[indexed] = true
+	return nil
+}
@@ -1,11 +1,16 @@
 package data
 
 import (
+	"errors"
+	"fmt"
+	"github.com/goinggo/straps"
 	"github.com/goinggo/task/helper"
 	"github.com/goinggo/task/mongo"
 	"github.com/goinggo/tracelog"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -13,6 +18,19 @@ import (
 
 const (
 	JOBS_COLLECTION = "data_jobs"
+
+	JOB_STATUS_PENDING   = "pending"
+	JOB_STATUS_RUNNING   = "running"
+	JOB_STATUS_COMPLETED = "completed"
+	JOB_STATUS_FAILED    = "failed"
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// ErrDuplicateJob is returned by StartJobWithOptions when a job with the same
+	// idempotency key is already running or has completed
+	ErrDuplicateJob = errors.New("Duplicate Job For Idempotency Key")
 )
 
 //** TYPES
@@ -27,11 +45,52 @@ type (
 
 	// Job contains information about a new processor job
 	Job struct {
-		ObjectId  bson.ObjectId `bson:"_id"`
-		Type      string        `bson:"type"`
-		StartDate time.Time     `bson:"start_date"`
-		Details   []JobDetail   `bson:"details"`
+		ObjectId        bson.ObjectId       `bson:"_id"`
+		SchemaVersion   int                 `bson:"schema_version"`
+		Type            string              `bson:"type"`
+		IdempotencyKey  string              `bson:"idempotency_key,omitempty"`
+		ReleasedKey     string              `bson:"released_key,omitempty"` // Key given up by a failed or imported job
+		Labels          Labels              `bson:"labels,omitempty"`
+		LabelIndex      []string            `bson:"label_index,omitempty"`
+		Status          string              `bson:"status"`
+		Priority        int                 `bson:"priority"`
+		QueueDate       time.Time           `bson:"queue_date,omitempty"`
+		Checkpoint      string              `bson:"checkpoint,omitempty"`
+		Preemption      *JobPreemption      `bson:"preemption,omitempty"`
+		StartDate       time.Time           `bson:"start_date"`
+		EndDate         time.Time           `bson:"end_date,omitempty"`
+		Result          string              `bson:"result,omitempty"`
+		Host            *JobHost            `bson:"host,omitempty"`
+		Workflow        *JobWorkflow        `bson:"workflow,omitempty"`
+		SLABreaches     []SLABreach         `bson:"sla_breaches,omitempty"`
+		Notes           []JobNote           `bson:"notes,omitempty"`
+		Acknowledgement *JobAcknowledgement `bson:"acknowledgement,omitempty"`
+		Details         []JobDetail         `bson:"details"`
+
+		detailWriter *DetailWriter // Buffered detail writer tied to this job
+		slaMonitor   *slaMonitor   // Alerts when the running job passes its SLA
+		lease        *jobLease     // Concurrency slot held while the job runs
+		preemptCheck time.Time     // When IsPreempted last read the job document
+	}
+
+	// JobOptions contains the optional settings for starting a job
+	JobOptions struct {
+		IdempotencyKey string // Prevents a second job for the same work, see StartJobWithOptions
+		Labels         Labels // Merged over the default labels from the jobLabels strap
+		Priority       int    // Higher priority jobs are claimed first, see ClaimNextJob
+	}
+
+	// JobFilter selects jobs to list or export
+	JobFilter struct {
+		Type   string    // Only jobs of this type when set
+		Status string    // Only jobs with this status when set
+		From   time.Time // Only jobs started on or after this time when set
+		To     time.Time // Only jobs started before this time when set
+		Labels Labels    // Only jobs with all of these labels when set
 	}
+
+	// Labels are key/value pairs such as customer or region used to filter jobs
+	Labels map[string]string
 )
 
 //** PUBLIC FUNCTIONS
@@ -59,7 +118,7 @@ func CleanJobs(goRoutine string, useSession string, useDatabase string) (err err
 		defer mongo.CloseSession(goRoutine, mongoSession)
 
 		// Access the jobs collection
-		collection, err := mongo.GetCollection(mongoSession, useDatabase, "jobs")
+		collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
 
 		if err != nil {
 			tracelog.CompletedError(err, goRoutine, "CleanJobs")
@@ -67,9 +126,21 @@ func CleanJobs(goRoutine string, useSession string, useDatabase string) (err err
 		}
 
 		removeDate := currentTime.AddDate(0, 0, -3)
-		query := bson.M{"startDate": bson.M{"$lt": removeDate}}
+		query := bson.M{"start_date": bson.M{"$lt": removeDate}}
 
-		if _, err = collection.RemoveAll(query); err != nil {
+		err = mongo.Measure(goRoutine, collection, "CleanJobs", query, func() (err error) {
+			_, err = collection.RemoveAll(query)
+			return err
+		})
+		if err != nil {
+			tracelog.CompletedError(err, goRoutine, "CleanJobs")
+			return err
+		}
+
+		// Artifacts are kept as long as the job they belong to
+		artifactQuery := bson.M{"metadata.job_start_date": bson.M{"$lt": removeDate}}
+
+		if _, err = removeArtifacts(goRoutine, mongoSession, useDatabase, artifactQuery); err != nil {
 			tracelog.CompletedError(err, goRoutine, "CleanJobs")
 			return err
 		}
@@ -81,14 +152,35 @@ func CleanJobs(goRoutine string, useSession string, useDatabase string) (err err
 
 // StartJob inserts a new job record into mongodb
 func StartJob(goRoutine string, useSession string, useDatabase string, jobType string) (job *Job, err error) {
-	defer helper.CatchPanic(&err, goRoutine, "StartJob")
+	return StartJobWithOptions(goRoutine, useSession, useDatabase, jobType, nil)
+}
 
-	tracelog.Startedf(goRoutine, "StartJob", "UseSession[%s] UseDatabase[%s] JobType[%s]", useSession, useDatabase, jobType)
+// StartJobWithKey inserts a new job record into mongodb using the specified idempotency key
+func StartJobWithKey(goRoutine string, useSession string, useDatabase string, jobType string, idempotencyKey string) (job *Job, err error) {
+	return StartJobWithOptions(goRoutine, useSession, useDatabase, jobType, &JobOptions{IdempotencyKey: idempotencyKey})
+}
+
+// StartJobWithOptions inserts a new job record into mongodb. If an idempotency key is provided and a job
+// with the same key is already running or has completed, the existing job is returned with ErrDuplicateJob.
+// If the job type is at its concurrency limit the job is recorded as failed and returned with
+// ErrConcurrencyLimit, or recorded as pending and returned with ErrJobQueued in queue mode, see
+// LoadConcurrencyLimit.
+func StartJobWithOptions(goRoutine string, useSession string, useDatabase string, jobType string, jobOptions *JobOptions) (job *Job, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "StartJobWithOptions")
+
+	if jobOptions == nil {
+		jobOptions = &JobOptions{}
+	}
+
+	idempotencyKey := jobOptions.IdempotencyKey
+	labels := DefaultLabels().Merge(jobOptions.Labels)
+
+	tracelog.Startedf(goRoutine, "StartJobWithOptions", "UseSession[%s] UseDatabase[%s] JobType[%s] IdempotencyKey[%s] Labels[%s]", useSession, useDatabase, jobType, idempotencyKey, labels)
 
 	// Grab a mongo session
 	mongoSession, err := mongo.CopySession(goRoutine, useSession)
 	if err != nil {
-		tracelog.CompletedError(err, goRoutine, "StartJob")
+		tracelog.CompletedError(err, goRoutine, "StartJobWithOptions")
 		return job, err
 	}
 
@@ -97,39 +189,98 @@ func StartJob(goRoutine string, useSession string, useDatabase string, jobType s
 	// Access the jobs collection
 	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
 	if err != nil {
-		tracelog.CompletedError(err, goRoutine, "StartJob")
+		tracelog.CompletedError(err, goRoutine, "StartJobWithOptions")
 		return job, err
 	}
 
+	if idempotencyKey != "" {
+		// Look for a job that already owns this key
+		job, err = claimIdempotencyKey(goRoutine, useSession, collection, idempotencyKey)
+		if err != nil {
+			tracelog.CompletedError(err, goRoutine, "StartJobWithOptions")
+			return job, err
+		}
+	}
+
 	// Create a new job
 	job = &Job{
-		ObjectId:  bson.NewObjectId(),
-		Type:      jobType,
-		StartDate: time.Now(),
+		ObjectId:       bson.NewObjectId(),
+		SchemaVersion:  JOB_SCHEMA_VERSION,
+		Type:           jobType,
+		IdempotencyKey: idempotencyKey,
+		Labels:         labels,
+		LabelIndex:     labels.index(),
+		Status:         JOB_STATUS_RUNNING,
+		Priority:       jobOptions.Priority,
+		StartDate:      time.Now(),
+		Host:           CurrentHost(),
+	}
+
+	// Take a concurrency slot for the job type, or record why the job did not run
+	leaseErr := acquireJobLease(goRoutine, useSession, mongoSession, useDatabase, job)
+	switch leaseErr {
+	case nil:
+		// The job may have waited for its slot
+		job.StartDate = time.Now()
+	case ErrJobQueued:
+		job.Status = JOB_STATUS_PENDING
+		job.QueueDate = job.StartDate
+	case ErrConcurrencyLimit:
+		job.Status = JOB_STATUS_FAILED
+		job.EndDate = time.Now()
+		job.Result = leaseErr.Error()
+	default:
+		tracelog.CompletedError(leaseErr, goRoutine, "StartJobWithOptions")
+		return nil, leaseErr
 	}
 
 	// Insert the job
-	err = collection.Insert(job)
+	err = mongo.Measure(goRoutine, collection, "StartJob", nil, func() error {
+		return collection.Insert(job)
+	})
 	if err != nil {
-		tracelog.CompletedError(err, goRoutine, "StartJob")
+		releaseJobLease(goRoutine, useSession, useDatabase, job)
+
+		// Another process inserted a job with the same key first
+		if idempotencyKey != "" && mgo.IsDup(err) {
+			job, err = findJobByKey(collection, idempotencyKey)
+			if err == nil {
+				err = ErrDuplicateJob
+			}
+		}
+
+		tracelog.CompletedError(err, goRoutine, "StartJobWithOptions")
 		return job, err
 	}
 
-	tracelog.Completed(goRoutine, "StartJob")
+	if leaseErr != nil {
+		tracelog.CompletedError(leaseErr, goRoutine, "StartJobWithOptions")
+		return job, leaseErr
+	}
+
+	// Check the start deadline and watch the duration
+	startSLA(goRoutine, useSession, useDatabase, job)
+
+	// Remember the job for the end of run summary
+	trackRunJob(job)
+
+	tracelog.Completed(goRoutine, "StartJobWithOptions")
 	return job, err
 }
 
-// EndJob updates the specified job document with end date and status
-func EndJob(goRoutine string, useSession string, useDatabase string, result string, job *Job) (err error) {
-	defer helper.CatchPanic(&err, goRoutine, "EndJob")
+// ClaimJob marks the pending job of the specified type with the highest effective priority as running and
+// returns it, see ClaimNextJob. Pending jobs are created by a workflow coordinator, queued by a concurrency
+// limit or yielded by a preempted job. A nil job is returned when none are pending or the job type is at its concurrency limit.
+func ClaimJob(goRoutine string, useSession string, useDatabase string, jobType string) (job *Job, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "ClaimJob")
 
-	tracelog.Startedf(goRoutine, "EndJob", "UseSession[%s] UseDatabase[%s] Id[%v] Result[%s]", useSession, useDatabase, job.ObjectId, result)
+	tracelog.Startedf(goRoutine, "ClaimJob", "UseSession[%s] UseDatabase[%s] JobType[%s]", useSession, useDatabase, jobType)
 
 	// Grab a mongo session
 	mongoSession, err := mongo.CopySession(goRoutine, useSession)
 	if err != nil {
-		tracelog.CompletedError(err, goRoutine, "EndJob")
-		return err
+		tracelog.CompletedError(err, goRoutine, "ClaimJob")
+		return job, err
 	}
 
 	defer mongo.CloseSession(goRoutine, mongoSession)
@@ -137,24 +288,123 @@ func EndJob(goRoutine string, useSession string, useDatabase string, result stri
 	// Access the jobs collection
 	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
 	if err != nil {
-		tracelog.CompletedError(err, goRoutine, "EndJob")
-		return err
+		tracelog.CompletedError(err, goRoutine, "ClaimJob")
+		return job, err
 	}
 
-	// Create the update document
-	update := bson.M{"$set": bson.M{"endDate": time.Now(), "result": result}}
-
-	// Update the job
-	err = collection.UpdateId(job.ObjectId, update)
+	// Rank the same way as ClaimNextJob so old low priority jobs are not starved
+	candidates, err := rankPendingJobs(goRoutine, collection, bson.M{"type": jobType, "status": JOB_STATUS_PENDING})
 	if err != nil {
-		tracelog.CompletedError(err, goRoutine, "EndJob")
+		tracelog.CompletedError(err, goRoutine, "ClaimJob")
+		return nil, err
+	}
+
+	for _, candidate := range candidates {
+		query := bson.M{"_id": candidate.ObjectId, "status": JOB_STATUS_PENDING}
+
+		job, err = claimPendingJob(goRoutine, useSession, mongoSession, useDatabase, collection, query)
+		if err == ErrConcurrencyLimit {
+			break
+		}
+
+		if err != nil {
+			tracelog.CompletedError(err, goRoutine, "ClaimJob")
+			return nil, err
+		}
+
+		if job != nil {
+			tracelog.Completedf(goRoutine, "ClaimJob", "Id[%v]", job.ObjectId)
+			return job, err
+		}
+	}
+
+	tracelog.Completedf(goRoutine, "ClaimJob", "No Job Claimed")
+	return nil, nil
+}
+
+// EndJob updates the specified job document with end date and status
+func EndJob(goRoutine string, useSession string, useDatabase string, result string, job *Job) (err error) {
+	return endJob(goRoutine, "EndJob", useSession, useDatabase, JOB_STATUS_COMPLETED, result, job)
+}
+
+// FailJob updates the specified job document with end date and a failed status and sends an alert
+// unless the last failure was acknowledged. The failed job keeps its idempotency key until a new job
+// is started with the same key, which takes the key over.
+func FailJob(goRoutine string, useSession string, useDatabase string, result string, job *Job) (err error) {
+	if err = endJob(goRoutine, "FailJob", useSession, useDatabase, JOB_STATUS_FAILED, result, job); err != nil {
 		return err
 	}
 
-	tracelog.Completed(goRoutine, "EndJob")
+	alertJobFailure(goRoutine, useSession, useDatabase, job, result)
 	return err
 }
 
+// ListJobs returns the jobs matching the filter, newest first, without their details
+func ListJobs(goRoutine string, useSession string, useDatabase string, jobFilter *JobFilter, limit int) (jobs []Job, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "ListJobs")
+
+	query := jobFilter.Query()
+
+	tracelog.Startedf(goRoutine, "ListJobs", "UseSession[%s] UseDatabase[%s] Query[%s] Limit[%d]", useSession, useDatabase, mongo.ToString(query), limit)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ListJobs")
+		return jobs, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ListJobs")
+		return jobs, err
+	}
+
+	err = mongo.Retry(goRoutine, mongoSession, "ListJobs", mongo.Instrument(goRoutine, collection, "ListJobs", query, func() error {
+		return collection.Find(query).Sort("-start_date").Select(bson.M{"details": 0}).Limit(limit).All(&jobs)
+	}))
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ListJobs")
+		return jobs, err
+	}
+
+	tracelog.Completedf(goRoutine, "ListJobs", "Count[%d]", len(jobs))
+	return jobs, err
+}
+
+// DefaultLabels returns the labels from the jobLabels strap, written as key=value pairs separated by commas
+func DefaultLabels() Labels {
+	return ParseLabels(straps.Strap("jobLabels"))
+}
+
+// ParseLabels parses key=value pairs separated by commas
+func ParseLabels(value string) Labels {
+	labels := Labels{}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return labels
+}
+
+// LabelQuery returns a query matching jobs that have all of the specified labels
+func LabelQuery(labels Labels) bson.M {
+	if len(labels) == 0 {
+		return bson.M{}
+	}
+
+	return bson.M{"label_index": bson.M{"$all": labels.index()}}
+}
+
 // AddJobDetail captures a session and then writes a job detail record to the specifed job
 func AddJobDetail(goRoutine string, useSession string, useDatabase string, job *Job, task string, details string) (err error) {
 	defer helper.CatchPanic(&err, goRoutine, "AddJobDetail")
@@ -175,7 +425,7 @@ func AddJobDetail(goRoutine string, useSession string, useDatabase string, job *
 func AddJobDetailWithSession(goRoutine string, mongoSession *mgo.Session, useDatabase string, job *Job, task string, details string) (err error) {
 	defer helper.CatchPanic(&err, goRoutine, "AddJobDetailWithSession")
 
-	tracelog.Startedf(goRoutine, "AddJobDetailWithSession", "UseDatabase[%s] Id[%v] Task[%v] Details[%s]", useDatabase, job.ObjectId, task, details)
+	tracelog.Startedf(goRoutine, "AddJobDetailWithSession", "UseDatabase[%s] Id[%v] Labels[%s] Task[%v] Details[%s]", useDatabase, job.ObjectId, job.Labels, task, details)
 
 	// Access the jobs collection
 	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
@@ -195,7 +445,10 @@ func AddJobDetailWithSession(goRoutine string, mongoSession *mgo.Session, useDat
 	update := bson.M{"$addToSet": bson.M{"details": jobDetail}}
 
 	// Update the job
-	_, err = collection.UpsertId(job.ObjectId, update)
+	err = mongo.Measure(goRoutine, collection, "AddJobDetail", bson.M{"_id": job.ObjectId}, func() (err error) {
+		_, err = collection.UpsertId(job.ObjectId, update)
+		return err
+	})
 	if err != nil {
 		tracelog.CompletedError(err, goRoutine, "AddJobDetailWithSession")
 		return err
@@ -204,3 +457,253 @@ func AddJobDetailWithSession(goRoutine string, mongoSession *mgo.Session, useDat
 	tracelog.Completed(goRoutine, "AddJobDetailWithSession")
 	return err
 }
+
+//** MEMBER FUNCTIONS
+
+// Query builds the mongo query for the filter
+func (jobFilter *JobFilter) Query() bson.M {
+	query := bson.M{}
+
+	if jobFilter.Type != "" {
+		query["type"] = jobFilter.Type
+	}
+
+	if jobFilter.Status != "" {
+		query["status"] = jobFilter.Status
+	}
+
+	startDate := bson.M{}
+	if !jobFilter.From.IsZero() {
+		startDate["$gte"] = jobFilter.From
+	}
+
+	if !jobFilter.To.IsZero() {
+		startDate["$lt"] = jobFilter.To
+	}
+
+	if len(startDate) > 0 {
+		query["start_date"] = startDate
+	}
+
+	for key, value := range LabelQuery(jobFilter.Labels) {
+		query[key] = value
+	}
+
+	return query
+}
+
+// Merge returns a copy of the labels with the overrides applied
+func (labels Labels) Merge(overrides Labels) Labels {
+	merged := Labels{}
+
+	for key, value := range labels {
+		merged[key] = value
+	}
+
+	for key, value := range overrides {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// String returns the labels as sorted key=value pairs
+func (labels Labels) String() string {
+	return strings.Join(labels.index(), ",")
+}
+
+// reportsError returns true if the detail mentions an error or a failure
+func (jobDetail *JobDetail) reportsError() bool {
+	return jobDetail.mentions("error", "fail")
+}
+
+// reportsWarning returns true if the detail mentions a warning, an error or a failure
+func (jobDetail *JobDetail) reportsWarning() bool {
+	return jobDetail.mentions("warn", "error", "fail")
+}
+
+// mentions returns true if the task or text of the detail contains any of the lower case words
+func (jobDetail *JobDetail) mentions(words ...string) bool {
+	text := strings.ToLower(jobDetail.Task + " " + jobDetail.Details)
+
+	for _, word := range words {
+		if strings.Contains(text, word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// index returns the sorted key=value pairs stored in label_index
+func (labels Labels) index() []string {
+	pairs := make([]string, 0, len(labels))
+
+	for key, value := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	sort.Strings(pairs)
+	return pairs
+}
+
+//** PRIVATE FUNCTIONS
+
+// endJob updates the specified job document with end date, status and result
+func endJob(goRoutine string, functionName string, useSession string, useDatabase string, status string, result string, job *Job) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, functionName)
+
+	tracelog.Startedf(goRoutine, functionName, "UseSession[%s] UseDatabase[%s] Id[%v] Labels[%s] Status[%s] Result[%s]", useSession, useDatabase, job.ObjectId, job.Labels, status, result)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, functionName)
+		return err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, functionName)
+		return err
+	}
+
+	// Write any buffered details before the job is closed out
+	if job.detailWriter != nil {
+		if err = job.detailWriter.Close(); err != nil {
+			tracelog.CompletedError(err, goRoutine, functionName)
+			return err
+		}
+	}
+
+	// Create the update document
+	job.EndDate = time.Now()
+	job.Status = status
+	job.Result = result
+	update := bson.M{"$set": bson.M{"end_date": job.EndDate, "status": status, "result": result}}
+
+	// Update the job, the $set is safe to repeat if the primary steps down
+	err = mongo.Retry(goRoutine, mongoSession, functionName, mongo.Instrument(goRoutine, collection, functionName, bson.M{"_id": job.ObjectId}, func() error {
+		return collection.UpdateId(job.ObjectId, update)
+	}))
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, functionName)
+		return err
+	}
+
+	// Free the concurrency slot for the next job
+	releaseJobLease(goRoutine, useSession, useDatabase, job)
+
+	// Check the final duration against the SLA
+	endSLA(goRoutine, useSession, useDatabase, job)
+
+	// Keep the finished job for the end of run summary
+	captureRunJob(goRoutine, collection, job)
+
+	tracelog.Completed(goRoutine, functionName)
+	return err
+}
+
+// claimPendingJob marks the pending job matching the query as running. A nil job is returned when
+// none match, and ErrConcurrencyLimit when the job type is at its limit.
+func claimPendingJob(goRoutine string, useSession string, mongoSession *mgo.Session, useDatabase string, collection *mgo.Collection, query bson.M) (job *Job, err error) {
+	startDate := time.Now()
+	host := CurrentHost()
+
+	// Atomically move the job to running so only one process gets it. The pending job is returned
+	// so it can be put back as it was.
+	change := mgo.Change{
+		Update: bson.M{"$set": bson.M{"status": JOB_STATUS_RUNNING, "start_date": startDate, "host": host}},
+	}
+
+	find := collection.Find(query)
+
+	previous := &Job{}
+
+	err = mongo.Measure(goRoutine, collection, "ClaimJob", query, func() (err error) {
+		_, err = find.Apply(change, previous)
+		return err
+	})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	claimed := *previous
+	job = &claimed
+	job.Status = JOB_STATUS_RUNNING
+	job.StartDate = startDate
+	job.Host = host
+
+	// Put the job back if the job type has no free concurrency slot
+	if err = claimJobLease(goRoutine, useSession, mongoSession, useDatabase, collection, job, previous); err != nil {
+		if err == ErrConcurrencyLimit {
+			tracelog.Trace(goRoutine, "claimPendingJob", "Info : Concurrency Limit Reached : Id[%v] JobType[%s]", job.ObjectId, job.Type)
+		}
+
+		return nil, err
+	}
+
+	// Check the start deadline and watch the duration
+	startSLA(goRoutine, useSession, useDatabase, job)
+
+	// Remember the job for the end of run summary
+	trackRunJob(job)
+
+	return job, err
+}
+
+// claimIdempotencyKey checks for a job already holding the key after making sure the unique index
+// exists, see ensureIdempotencyIndex. A failed job gives up its key so a new job can take it. Any
+// other job is returned with ErrDuplicateJob.
+func claimIdempotencyKey(goRoutine string, useSession string, collection *mgo.Collection, idempotencyKey string) (job *Job, err error) {
+	if err = ensureIdempotencyIndex(goRoutine, useSession, collection); err != nil {
+		return nil, err
+	}
+
+	job, err = findJobByKey(collection, idempotencyKey)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return job, err
+	}
+
+	if job.Status != JOB_STATUS_FAILED {
+		tracelog.Trace(goRoutine, "claimIdempotencyKey", "Info : Job Exists : Id[%v] Status[%s]", job.ObjectId, job.Status)
+		return job, ErrDuplicateJob
+	}
+
+	// Release the key held by the failed job
+	tracelog.Trace(goRoutine, "claimIdempotencyKey", "Info : Releasing Key From Failed Job : Id[%v]", job.ObjectId)
+
+	query := bson.M{"_id": job.ObjectId, "status": JOB_STATUS_FAILED}
+	update := bson.M{"$unset": bson.M{"idempotency_key": ""}, "$set": bson.M{"released_key": idempotencyKey}}
+
+	err = mongo.Measure(goRoutine, collection, "ReleaseIdempotencyKey", query, func() error {
+		return collection.Update(query, update)
+	})
+	if err != nil && err != mgo.ErrNotFound {
+		return job, err
+	}
+
+	return nil, nil
+}
+
+// findJobByKey locates the job holding the specified idempotency key
+func findJobByKey(collection *mgo.Collection, idempotencyKey string) (job *Job, err error) {
+	job = &Job{}
+
+	if err = collection.Find(bson.M{"idempotency_key": idempotencyKey}).One(job); err != nil {
+		return nil, err
+	}
+
+	return job, err
+}
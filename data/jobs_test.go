@@ -0,0 +1,465 @@
+package data
+
+import (
+	"encoding/binary"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	opReply = 1
+	opQuery = 2004
+)
+
+//** TYPES
+
+type (
+	// fakeJobs is a mongo server that keeps documents in memory by collection. It answers the
+	// handshake, finds by equality, inserts with unique ids, single document $set and $unset
+	// updates and removes, and counts the commands it runs.
+	fakeJobs struct {
+		listener  net.Listener
+		waitGroup sync.WaitGroup
+
+		mutex       sync.Mutex
+		conns       []net.Conn
+		collections map[string][]bson.M
+		commands    map[string]int
+	}
+)
+
+//** TESTS
+
+// TestClaimIdempotencyKey checks only a failed job gives up its key, and that the unique index is
+// ensured once per session and database
+func TestClaimIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    string // Status of the job already holding the key, none when empty
+		duplicate bool
+	}{
+		{"no job", "", false},
+		{"pending", JOB_STATUS_PENDING, true},
+		{"running", JOB_STATUS_RUNNING, true},
+		{"completed", JOB_STATUS_COMPLETED, true},
+		{"failed", JOB_STATUS_FAILED, false},
+	}
+
+	server := startFakeJobs(t)
+	defer server.close()
+
+	mongoSession, err := mgo.DialWithTimeout(server.listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to dial the fake server : %s", err)
+	}
+	defer mongoSession.Close()
+
+	collection := mongoSession.DB("test").C(JOBS_COLLECTION)
+
+	for _, test := range tests {
+		idempotencyKey := "nightly-" + test.name
+
+		var holder bson.ObjectId
+		if test.status != "" {
+			holder = bson.NewObjectId()
+			server.insert(JOBS_COLLECTION, &Job{ObjectId: holder, Type: "nightly", Status: test.status, IdempotencyKey: idempotencyKey})
+		}
+
+		job, err := claimIdempotencyKey("test", "TestClaimIdempotencyKey", collection, idempotencyKey)
+
+		if test.duplicate {
+			if err != ErrDuplicateJob || job == nil || job.ObjectId != holder {
+				t.Errorf("%s : Expected the holding job and ErrDuplicateJob, got %v %v", test.name, job, err)
+			}
+			continue
+		}
+
+		if err != nil || job != nil {
+			t.Errorf("%s : Expected the key to be claimed, got %v %v", test.name, job, err)
+			continue
+		}
+
+		// The failed job keeps the key it gave up as a released key
+		if holder != "" {
+			document := server.find(JOBS_COLLECTION, holder)
+			if _, ok := document["idempotency_key"]; ok || document["released_key"] != idempotencyKey {
+				t.Errorf("%s : Expected the key to be released, got %v", test.name, document)
+			}
+		}
+	}
+
+	if created := server.count("createIndexes"); created != 1 {
+		t.Errorf("Expected the idempotency index to be ensured once, got %d", created)
+	}
+}
+
+// TestParseLabels checks key=value pairs are parsed and malformed pairs are skipped
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		value  string
+		labels Labels
+	}{
+		{"", Labels{}},
+		{"customer=acme", Labels{"customer": "acme"}},
+		{" customer = acme , region=us ", Labels{"customer": "acme", "region": "us"}},
+		{"query=a=b", Labels{"query": "a=b"}},
+		{"empty=", Labels{"empty": ""}},
+		{"novalue,=nokey,,customer=acme", Labels{"customer": "acme"}},
+	}
+
+	for _, test := range tests {
+		if labels := ParseLabels(test.value); !reflect.DeepEqual(labels, test.labels) {
+			t.Errorf("%q : Expected %v, got %v", test.value, test.labels, labels)
+		}
+	}
+}
+
+// TestJobFilterQuery checks the filter query, including the sorted label pairs matched with $all
+func TestJobFilterQuery(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 1)
+
+	tests := []struct {
+		name      string
+		jobFilter JobFilter
+		query     bson.M
+	}{
+		{"empty", JobFilter{}, bson.M{}},
+		{"type and status", JobFilter{Type: "nightly", Status: JOB_STATUS_FAILED}, bson.M{"type": "nightly", "status": JOB_STATUS_FAILED}},
+		{"from", JobFilter{From: from}, bson.M{"start_date": bson.M{"$gte": from}}},
+		{"range", JobFilter{From: from, To: to}, bson.M{"start_date": bson.M{"$gte": from, "$lt": to}}},
+		{"labels", JobFilter{Labels: Labels{"region": "us", "customer": "acme"}}, bson.M{"label_index": bson.M{"$all": []string{"customer=acme", "region=us"}}}},
+		{"empty labels", JobFilter{Labels: Labels{}}, bson.M{}},
+	}
+
+	for _, test := range tests {
+		if query := test.jobFilter.Query(); !reflect.DeepEqual(query, test.query) {
+			t.Errorf("%s : Expected %v, got %v", test.name, test.query, query)
+		}
+	}
+}
+
+// TestLabelsMerge checks overrides win and neither set of labels is changed
+func TestLabelsMerge(t *testing.T) {
+	defaults := Labels{"customer": "acme", "region": "us"}
+	overrides := Labels{"region": "eu", "tier": "gold"}
+
+	merged := defaults.Merge(overrides)
+
+	if expected := (Labels{"customer": "acme", "region": "eu", "tier": "gold"}); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Expected %v, got %v", expected, merged)
+	}
+
+	if defaults["region"] != "us" || len(overrides) != 2 {
+		t.Errorf("Expected the merged labels to be left unchanged")
+	}
+
+	if text := merged.String(); text != "customer=acme,region=eu,tier=gold" {
+		t.Errorf("Expected the sorted pairs, got %s", text)
+	}
+}
+
+//** PRIVATE FUNCTIONS
+
+// startFakeJobs listens on a local port and answers mgo until it is closed
+func startFakeJobs(t *testing.T) *fakeJobs {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen : %s", err)
+	}
+
+	server := &fakeJobs{listener: listener, collections: map[string][]bson.M{}, commands: map[string]int{}}
+
+	server.waitGroup.Add(1)
+	go func() {
+		defer server.waitGroup.Done()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.mutex.Lock()
+			server.conns = append(server.conns, conn)
+			server.mutex.Unlock()
+
+			server.waitGroup.Add(1)
+			go func() {
+				defer server.waitGroup.Done()
+				server.serve(conn)
+			}()
+		}
+	}()
+
+	return server
+}
+
+// close stops listening and drops the connections
+func (server *fakeJobs) close() {
+	server.listener.Close()
+
+	server.mutex.Lock()
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.mutex.Unlock()
+
+	server.waitGroup.Wait()
+}
+
+// insert stores the document in the collection as mgo would write it
+func (server *fakeJobs) insert(collectionName string, value interface{}) {
+	data, _ := bson.Marshal(value)
+
+	var document bson.M
+	bson.Unmarshal(data, &document)
+
+	server.mutex.Lock()
+	server.collections[collectionName] = append(server.collections[collectionName], document)
+	server.mutex.Unlock()
+}
+
+// find returns the stored document with the id
+func (server *fakeJobs) find(collectionName string, id interface{}) bson.M {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for _, document := range server.collections[collectionName] {
+		if document["_id"] == id {
+			return document
+		}
+	}
+
+	return nil
+}
+
+// count returns the number of times the command was run
+func (server *fakeJobs) count(command string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.commands[command]
+}
+
+// serve answers each OP_QUERY on the connection with an OP_REPLY
+func (server *fakeJobs) serve(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 16)
+
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		length := int(binary.LittleEndian.Uint32(header[0:]))
+		requestId := binary.LittleEndian.Uint32(header[4:])
+		opCode := binary.LittleEndian.Uint32(header[12:])
+
+		body := make([]byte, length-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		if opCode != opQuery {
+			continue
+		}
+
+		// Skip the flags, then read the collection name and skip the number to skip and return
+		end := 4
+		for end < len(body) && body[end] != 0 {
+			end++
+		}
+
+		// The command name is the first field so read the order as well as the fields
+		var order bson.D
+		var query bson.M
+		if end+9 > len(body) || bson.Unmarshal(body[end+9:], &order) != nil || bson.Unmarshal(body[end+9:], &query) != nil {
+			return
+		}
+
+		message := make([]byte, 36)
+		documents := server.answer(string(body[4:end]), order, query)
+		for _, document := range documents {
+			reply, err := bson.Marshal(document)
+			if err != nil {
+				return
+			}
+			message = append(message, reply...)
+		}
+
+		binary.LittleEndian.PutUint32(message[0:], uint32(len(message)))
+		binary.LittleEndian.PutUint32(message[8:], requestId)
+		binary.LittleEndian.PutUint32(message[12:], opReply)
+		binary.LittleEndian.PutUint32(message[32:], uint32(len(documents)))
+
+		if _, err := conn.Write(message); err != nil {
+			return
+		}
+	}
+}
+
+// answer runs the command or query against the stored documents
+func (server *fakeJobs) answer(collectionName string, order bson.D, query bson.M) []bson.M {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if !strings.HasSuffix(collectionName, ".$cmd") {
+		filter := query
+		if wrapped, ok := filter["$query"].(bson.M); ok {
+			filter = wrapped
+		}
+
+		var found []bson.M
+		for _, document := range server.collections[collectionName[strings.Index(collectionName, ".")+1:]] {
+			if matches(document, filter) {
+				found = append(found, document)
+			}
+		}
+
+		return found
+	}
+
+	if len(order) == 0 {
+		return []bson.M{{"ok": 0}}
+	}
+
+	command := order[0].Name
+	server.commands[command]++
+
+	// Write commands name their collection
+	target, _ := order[0].Value.(string)
+
+	switch command {
+	case "getnonce":
+		return []bson.M{{"nonce": "2375531c32080ae8", "ok": 1}}
+
+	case "ismaster", "isMaster":
+		return []bson.M{{"ismaster": true, "ok": 1, "maxWireVersion": 2, "minWireVersion": 0}}
+
+	case "update":
+		updated := 0
+
+		updates, _ := query["updates"].([]interface{})
+		for _, value := range updates {
+			update, _ := value.(bson.M)
+			filter, _ := update["q"].(bson.M)
+			change, _ := update["u"].(bson.M)
+
+			for _, document := range server.collections[target] {
+				if !matches(document, filter) {
+					continue
+				}
+
+				set, setting := change["$set"].(bson.M)
+				unset, unsetting := change["$unset"].(bson.M)
+
+				// An update without operators replaces the document
+				if !setting && !unsetting {
+					for name := range document {
+						if name != "_id" {
+							delete(document, name)
+						}
+					}
+					set = change
+				}
+
+				for name, value := range set {
+					document[name] = value
+				}
+
+				for name := range unset {
+					delete(document, name)
+				}
+
+				updated++
+				break
+			}
+		}
+
+		return []bson.M{{"ok": 1, "n": updated, "nModified": updated}}
+
+	case "insert":
+		inserted := 0
+		var writeErrors []bson.M
+
+		documents, _ := query["documents"].([]interface{})
+		for index, value := range documents {
+			document, _ := value.(bson.M)
+
+			duplicate := false
+			for _, existing := range server.collections[target] {
+				if existing["_id"] == document["_id"] {
+					duplicate = true
+				}
+			}
+
+			if duplicate {
+				writeErrors = append(writeErrors, bson.M{"index": index, "code": 11000, "errmsg": "E11000 duplicate key error"})
+				continue
+			}
+
+			server.collections[target] = append(server.collections[target], document)
+			inserted++
+		}
+
+		if len(writeErrors) > 0 {
+			return []bson.M{{"ok": 1, "n": inserted, "writeErrors": writeErrors}}
+		}
+
+		return []bson.M{{"ok": 1, "n": inserted}}
+
+	case "delete":
+		removed := 0
+
+		deletes, _ := query["deletes"].([]interface{})
+		for _, value := range deletes {
+			remove, _ := value.(bson.M)
+			filter, _ := remove["q"].(bson.M)
+
+			documents := server.collections[target]
+			for index, document := range documents {
+				if matches(document, filter) {
+					server.collections[target] = append(documents[:index], documents[index+1:]...)
+					removed++
+					break
+				}
+			}
+		}
+
+		return []bson.M{{"ok": 1, "n": removed}}
+	}
+
+	return []bson.M{{"ok": 1}}
+}
+
+// matches returns true if every field of the filter equals the document's field, or is a time
+// before the time of a $lt filter
+func matches(document bson.M, filter bson.M) bool {
+	for name, value := range filter {
+		if operator, ok := value.(bson.M); ok {
+			before, _ := operator["$lt"].(time.Time)
+			date, _ := document[name].(time.Time)
+			if len(operator) != 1 || before.IsZero() || !date.Before(before) {
+				return false
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(document[name], value) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,165 @@
+package data
+
+import (
+	"errors"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// ErrNotFailed is returned when acknowledging a job that has not failed
+	ErrNotFailed = errors.New("Only Failed Jobs Can Be Acknowledged")
+)
+
+//** TYPES
+
+type (
+	// JobNote is an operator's note on a job
+	JobNote struct {
+		Author      string    `bson:"author"`
+		Date        time.Time `bson:"date"`
+		Text        string    `bson:"text"`
+		Acknowledge bool      `bson:"acknowledge,omitempty"`
+	}
+
+	// JobAcknowledgement records that an operator knows about a failure. Later failures of
+	// the same job type and labels inherit it and do not alert until the job succeeds again.
+	JobAcknowledgement struct {
+		Author        string        `bson:"author"`
+		Date          time.Time     `bson:"date"`
+		Text          string        `bson:"text"`
+		InheritedFrom bson.ObjectId `bson:"inherited_from,omitempty"`
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// AddJobNote appends an operator note to the job. An acknowledging note also acknowledges
+// the job's failure, which suppresses alerts for repeat failures.
+func AddJobNote(goRoutine string, useSession string, useDatabase string, jobId bson.ObjectId, author string, text string, acknowledge bool) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "AddJobNote")
+
+	tracelog.Startedf(goRoutine, "AddJobNote", "UseSession[%s] UseDatabase[%s] Id[%v] Author[%s] Acknowledge[%v]", useSession, useDatabase, jobId, author, acknowledge)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "AddJobNote")
+		return err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "AddJobNote")
+		return err
+	}
+
+	note := &JobNote{
+		Author:      author,
+		Date:        time.Now(),
+		Text:        text,
+		Acknowledge: acknowledge,
+	}
+
+	query := bson.M{"_id": jobId}
+	update := bson.M{"$push": bson.M{"notes": note}}
+
+	if acknowledge {
+		query["status"] = JOB_STATUS_FAILED
+		update["$set"] = bson.M{"acknowledgement": &JobAcknowledgement{
+			Author: author,
+			Date:   note.Date,
+			Text:   text,
+		}}
+	}
+
+	err = mongo.Measure(goRoutine, collection, "AddJobNote", query, func() error {
+		return collection.Update(query, update)
+	})
+	if err != nil {
+		if err == mgo.ErrNotFound && acknowledge {
+			err = ErrNotFailed
+		}
+
+		tracelog.CompletedError(err, goRoutine, "AddJobNote")
+		return err
+	}
+
+	tracelog.Completed(goRoutine, "AddJobNote")
+	return err
+}
+
+//** PRIVATE FUNCTIONS
+
+// alertJobFailure sends the failure alert unless the previous run of the same job type and
+// labels failed and was acknowledged. A suppressed failure inherits the acknowledgement.
+func alertJobFailure(goRoutine string, useSession string, useDatabase string, job *Job, result string) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "alertJobFailure")
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		SendJobAlert(goRoutine, job, "Job Failed", result)
+		return err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		SendJobAlert(goRoutine, job, "Job Failed", result)
+		return err
+	}
+
+	// Find the last run that started and finished before this one, ignoring overlapping and later runs
+	query := bson.M{
+		"_id":         bson.M{"$ne": job.ObjectId},
+		"type":        job.Type,
+		"start_date":  bson.M{"$lt": job.StartDate},
+		"end_date":    bson.M{"$lte": job.EndDate},
+		"label_index": job.Labels.index(),
+		"status":      bson.M{"$in": []string{JOB_STATUS_COMPLETED, JOB_STATUS_FAILED}},
+	}
+
+	if len(job.Labels) == 0 {
+		query["label_index"] = bson.M{"$exists": false}
+	}
+
+	var previous Job
+	err = mongo.Measure(goRoutine, collection, "FindPreviousRun", query, func() error {
+		return collection.Find(query).Sort("-end_date").Select(bson.M{"details": 0}).One(&previous)
+	})
+
+	if err != nil || previous.Status != JOB_STATUS_FAILED || previous.Acknowledgement == nil {
+		if err == mgo.ErrNotFound {
+			err = nil
+		}
+
+		SendJobAlert(goRoutine, job, "Job Failed", result)
+		return err
+	}
+
+	// Carry the acknowledgement forward so the next failure is also suppressed
+	acknowledgement := *previous.Acknowledgement
+	if acknowledgement.InheritedFrom == "" {
+		acknowledgement.InheritedFrom = previous.ObjectId
+	}
+
+	job.Acknowledgement = &acknowledgement
+
+	tracelog.Trace(goRoutine, "alertJobFailure", "Info : Alert Suppressed, Failure Acknowledged : Id[%v] By[%s] InheritedFrom[%v]", job.ObjectId, acknowledgement.Author, acknowledgement.InheritedFrom)
+
+	return mongo.Measure(goRoutine, collection, "InheritAcknowledgement", bson.M{"_id": job.ObjectId}, func() error {
+		return collection.UpdateId(job.ObjectId, bson.M{"$set": bson.M{"acknowledgement": &acknowledgement}})
+	})
+}
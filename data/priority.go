@@ -0,0 +1,381 @@
+package data
+
+import (
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	JOB_PRIORITY_BULK   = -10
+	JOB_PRIORITY_NORMAL = 0
+	JOB_PRIORITY_HIGH   = 10
+	JOB_PRIORITY_URGENT = 20
+
+	// PRIORITY_AGING_INTERVAL is how long a pending job waits to gain one point of priority,
+	// so bulk jobs are eventually claimed ahead of a steady stream of urgent ones
+	PRIORITY_AGING_INTERVAL = 5 * time.Minute
+
+	// PREEMPT_CHECK_INTERVAL limits how often IsPreempted reads the job document
+	PREEMPT_CHECK_INTERVAL = 10 * time.Second
+
+	// claimCandidates is how many pending jobs ClaimNextJob tries before giving up
+	claimCandidates = 10
+)
+
+//** TYPES
+
+type (
+	// JobPreemption records that a higher priority job asked a running job to yield
+	JobPreemption struct {
+		Priority int           `bson:"priority"`
+		JobId    bson.ObjectId `bson:"job_id,omitempty"`
+		Date     time.Time     `bson:"date"`
+	}
+
+	// claimCandidate is a pending job ranked by rankPendingJobs
+	claimCandidate struct {
+		ObjectId  bson.ObjectId `bson:"_id"`
+		Type      string        `bson:"type"`
+		Priority  int           `bson:"priority"`
+		Effective float64       `bson:"effective"`
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// ClaimNextJob marks the pending job of any of the job types with the highest effective priority as
+// running and returns it. A job's effective priority grows by one for every PRIORITY_AGING_INTERVAL it
+// has been waiting so low priority types are not starved. When an urgent job cannot be claimed because
+// its type is at the concurrency limit, a lower priority running job of the type is asked to yield.
+// A nil job is returned when no job could be claimed.
+func ClaimNextJob(goRoutine string, useSession string, useDatabase string, jobTypes []string) (job *Job, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "ClaimNextJob")
+
+	tracelog.Startedf(goRoutine, "ClaimNextJob", "UseSession[%s] UseDatabase[%s] JobTypes%v", useSession, useDatabase, jobTypes)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ClaimNextJob")
+		return job, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "ClaimNextJob")
+		return job, err
+	}
+
+	limited := map[string]bool{}
+
+	for {
+		// Leave out the types at their limit so their pending jobs do not crowd out the others
+		claimable := claimableTypes(jobTypes, limited)
+		if len(claimable) == 0 {
+			break
+		}
+
+		// Rank the pending jobs by priority plus the time they have been waiting
+		var candidates []claimCandidate
+		candidates, err = rankPendingJobs(goRoutine, collection, bson.M{"type": bson.M{"$in": claimable}, "status": JOB_STATUS_PENDING})
+		if err != nil {
+			tracelog.CompletedError(err, goRoutine, "ClaimNextJob")
+			return nil, err
+		}
+
+		reachedLimit := false
+
+		for _, candidate := range candidates {
+			// The other jobs of a type at its limit cannot be claimed either
+			if limited[candidate.Type] {
+				continue
+			}
+
+			query := bson.M{"_id": candidate.ObjectId, "status": JOB_STATUS_PENDING}
+
+			job, err = claimPendingJob(goRoutine, useSession, mongoSession, useDatabase, collection, query)
+			if err == ErrConcurrencyLimit {
+				limited[candidate.Type] = true
+				reachedLimit = true
+
+				// Make room for an urgent job unless it already asked a job to yield
+				if candidate.Priority >= JOB_PRIORITY_URGENT {
+					if _, err = preemptJob(goRoutine, collection, candidate.Type, candidate.Priority, candidate.ObjectId); err != nil {
+						tracelog.Error(err, goRoutine, "ClaimNextJob")
+					}
+				}
+
+				continue
+			}
+
+			if err != nil {
+				tracelog.CompletedError(err, goRoutine, "ClaimNextJob")
+				return nil, err
+			}
+
+			if job != nil {
+				tracelog.Completedf(goRoutine, "ClaimNextJob", "Id[%v] JobType[%s] Priority[%d] Effective[%.1f]", job.ObjectId, job.Type, candidate.Priority, candidate.Effective)
+				return job, err
+			}
+
+			// Another process claimed the job first
+		}
+
+		// Rank again without the types found at their limit, the other candidates were claimed
+		// by other processes
+		if !reachedLimit {
+			break
+		}
+	}
+
+	tracelog.Completedf(goRoutine, "ClaimNextJob", "No Job Claimed")
+	return nil, nil
+}
+
+// RequestPreemption asks the lowest priority running job of the type with a priority below the
+// specified priority to yield. The job sees the request through IsPreempted. A nil job is returned
+// when there is no such job.
+func RequestPreemption(goRoutine string, useSession string, useDatabase string, jobType string, priority int) (job *Job, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "RequestPreemption")
+
+	tracelog.Startedf(goRoutine, "RequestPreemption", "UseSession[%s] UseDatabase[%s] JobType[%s] Priority[%d]", useSession, useDatabase, jobType, priority)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "RequestPreemption")
+		return job, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "RequestPreemption")
+		return job, err
+	}
+
+	if job, err = preemptJob(goRoutine, collection, jobType, priority, ""); err != nil {
+		tracelog.CompletedError(err, goRoutine, "RequestPreemption")
+		return nil, err
+	}
+
+	tracelog.Completed(goRoutine, "RequestPreemption")
+	return job, err
+}
+
+// YieldJob gives up a running job that was asked to yield. The job goes back to pending with the
+// checkpoint so whoever claims it next can resume from there.
+func YieldJob(goRoutine string, useSession string, useDatabase string, checkpoint string, job *Job) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "YieldJob")
+
+	tracelog.Startedf(goRoutine, "YieldJob", "UseSession[%s] UseDatabase[%s] Id[%v] Checkpoint[%s]", useSession, useDatabase, job.ObjectId, checkpoint)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "YieldJob")
+		return err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "YieldJob")
+		return err
+	}
+
+	// Write any buffered details before the job is given up
+	if job.detailWriter != nil {
+		if err = job.detailWriter.Close(); err != nil {
+			tracelog.CompletedError(err, goRoutine, "YieldJob")
+			return err
+		}
+	}
+
+	// Keep the job's place in the queue so it keeps aging
+	if job.QueueDate.IsZero() {
+		job.QueueDate = job.StartDate
+	}
+
+	job.Status = JOB_STATUS_PENDING
+	job.Checkpoint = checkpoint
+	job.Preemption = nil
+
+	update := bson.M{
+		"$set":   bson.M{"status": JOB_STATUS_PENDING, "checkpoint": checkpoint, "queue_date": job.QueueDate},
+		"$unset": bson.M{"preemption": "", "host": ""},
+	}
+
+	err = mongo.Measure(goRoutine, collection, "YieldJob", bson.M{"_id": job.ObjectId}, func() error {
+		return collection.UpdateId(job.ObjectId, update)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "YieldJob")
+		return err
+	}
+
+	// Free the concurrency slot for the job that asked for it
+	releaseJobLease(goRoutine, useSession, useDatabase, job)
+
+	if job.slaMonitor != nil {
+		job.slaMonitor.stop()
+	}
+
+	forgetRunJob(job)
+
+	tracelog.Completed(goRoutine, "YieldJob")
+	return err
+}
+
+//** MEMBER FUNCTIONS
+
+// IsPreempted returns true if a higher priority job asked this job to yield. Long running jobs
+// call it alongside controller.IsShutdown and call YieldJob at a safe point when it returns true.
+// The job document is read at most once every PREEMPT_CHECK_INTERVAL.
+func (job *Job) IsPreempted(goRoutine string, useSession string, useDatabase string) bool {
+	if job.Preemption != nil || time.Since(job.preemptCheck) < PREEMPT_CHECK_INTERVAL {
+		return job.Preemption != nil
+	}
+
+	job.preemptCheck = time.Now()
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.Error(err, goRoutine, "IsPreempted")
+		return false
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.Error(err, goRoutine, "IsPreempted")
+		return false
+	}
+
+	var current Job
+	err = mongo.Measure(goRoutine, collection, "IsPreempted", bson.M{"_id": job.ObjectId}, func() error {
+		return collection.FindId(job.ObjectId).Select(bson.M{"preemption": 1}).One(&current)
+	})
+	if err != nil {
+		tracelog.Error(err, goRoutine, "IsPreempted")
+		return false
+	}
+
+	if current.Preemption != nil {
+		tracelog.Trace(goRoutine, "IsPreempted", "Info : Job Asked To Yield : Id[%v] Priority[%d] By[%v]", job.ObjectId, current.Preemption.Priority, current.Preemption.JobId)
+		job.Preemption = current.Preemption
+	}
+
+	return job.Preemption != nil
+}
+
+//** PRIVATE FUNCTIONS
+
+// claimableTypes returns the job types that are not at their concurrency limit
+func claimableTypes(jobTypes []string, limited map[string]bool) (claimable []string) {
+	for _, jobType := range jobTypes {
+		if !limited[jobType] {
+			claimable = append(claimable, jobType)
+		}
+	}
+
+	return claimable
+}
+
+// rankPendingJobs returns up to claimCandidates pending jobs matching the query ordered by effective
+// priority, which is the priority plus one for every PRIORITY_AGING_INTERVAL the job has been waiting
+func rankPendingJobs(goRoutine string, collection *mgo.Collection, match bson.M) (candidates []claimCandidate, err error) {
+	now := time.Now()
+	agingMilliseconds := float64(PRIORITY_AGING_INTERVAL / time.Millisecond)
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$project": bson.M{
+			"type":     1,
+			"priority": 1,
+			"effective": bson.M{"$add": []interface{}{
+				bson.M{"$ifNull": []interface{}{"$priority", JOB_PRIORITY_NORMAL}},
+				bson.M{"$divide": []interface{}{
+					bson.M{"$subtract": []interface{}{now, bson.M{"$ifNull": []interface{}{"$queue_date", "$start_date"}}}},
+					agingMilliseconds,
+				}},
+			}},
+		}},
+		{"$sort": bson.D{{Name: "effective", Value: -1}, {Name: "_id", Value: 1}}},
+		{"$limit": claimCandidates},
+	}
+
+	err = mongo.Measure(goRoutine, collection, "RankPendingJobs", match, func() error {
+		return collection.Pipe(pipeline).All(&candidates)
+	})
+	return candidates, err
+}
+
+// preemptJob marks the lowest priority, most recently started running job of the type that has
+// not already been asked to yield. Nothing is marked while a job asked to yield for requestedBy is
+// still running. A nil job is returned when there is none.
+func preemptJob(goRoutine string, collection *mgo.Collection, jobType string, priority int, requestedBy bson.ObjectId) (job *Job, err error) {
+	if requestedBy != "" {
+		query := bson.M{"status": JOB_STATUS_RUNNING, "preemption.job_id": requestedBy}
+
+		var outstanding int
+		err := mongo.Measure(goRoutine, collection, "CountPreempted", query, func() (err error) {
+			outstanding, err = collection.Find(query).Count()
+			return err
+		})
+		if err != nil || outstanding > 0 {
+			return nil, err
+		}
+	}
+
+	query := bson.M{
+		"type":       jobType,
+		"status":     JOB_STATUS_RUNNING,
+		"preemption": bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"priority": bson.M{"$lt": priority}},
+			{"priority": bson.M{"$exists": false}},
+		},
+	}
+
+	change := mgo.Change{
+		Update: bson.M{"$set": bson.M{"preemption": &JobPreemption{
+			Priority: priority,
+			JobId:    requestedBy,
+			Date:     time.Now(),
+		}}},
+		ReturnNew: true,
+	}
+
+	job = &Job{}
+	err = mongo.Measure(goRoutine, collection, "PreemptJob", query, func() (err error) {
+		_, err = collection.Find(query).Sort("priority", "-start_date").Select(bson.M{"details": 0}).Apply(change, job)
+		return err
+	})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	tracelog.Trace(goRoutine, "preemptJob", "Info : Asked Job To Yield : Id[%v] JobType[%s] Priority[%d] For[%d]", job.ObjectId, jobType, job.Priority, priority)
+	return job, err
+}
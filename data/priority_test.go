@@ -0,0 +1,29 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+//** TESTS
+
+// TestClaimableTypes checks the types at their concurrency limit are left out of the next ranking
+func TestClaimableTypes(t *testing.T) {
+	jobTypes := []string{"load", "report", "transform"}
+
+	tests := []struct {
+		limited   map[string]bool
+		claimable []string
+	}{
+		{map[string]bool{}, jobTypes},
+		{map[string]bool{"report": true}, []string{"load", "transform"}},
+		{map[string]bool{"load": true, "transform": true}, []string{"report"}},
+		{map[string]bool{"load": true, "report": true, "transform": true}, nil},
+	}
+
+	for _, test := range tests {
+		if claimable := claimableTypes(jobTypes, test.limited); !reflect.DeepEqual(claimable, test.claimable) {
+			t.Errorf("%v : Expected %v, got %v", test.limited, test.claimable, claimable)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package data
+
+import (
+	"fmt"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+)
+
+//** CONSTANTS
+
+const (
+	// JOB_SCHEMA_VERSION is the layout written by this package. Documents without a
+	// schema_version field are version 1.
+	JOB_SCHEMA_VERSION = 2
+
+	// JOB_MIGRATION_NAMESPACE keeps the versions of this package's migrations apart from those
+	// registered by task programs
+	JOB_MIGRATION_NAMESPACE = "data"
+
+	// JOB_SCHEMA_MIGRATION is the version of the migration that upgrades stored job documents
+	JOB_SCHEMA_MIGRATION = 1
+
+	JOB_MIGRATION_BATCH_SIZE = 500
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// jobMigrations upgrade a job document one version at a time, in order. Documents are
+	// upgraded in memory when they are read and in place by the JOB_SCHEMA_MIGRATION migration.
+	jobMigrations = []jobMigration{
+		{2, "Rename startDate and endDate to start_date and end_date, set missing status", upgradeJobV2},
+	}
+)
+
+//** TYPES
+
+type (
+	// jobMigration upgrades a job document in memory to Version
+	jobMigration struct {
+		Version     int
+		Description string
+		Upgrade     func(document bson.M)
+	}
+
+	// jobAlias has the fields of Job without its SetBSON method
+	jobAlias Job
+)
+
+//** MEMBER FUNCTIONS
+
+// SetBSON decodes a job document of any schema version, upgrading older layouts in memory
+func (job *Job) SetBSON(raw bson.Raw) (err error) {
+	var alias jobAlias
+	if err = raw.Unmarshal(&alias); err != nil {
+		return err
+	}
+
+	// Upgrade older documents and decode them again
+	if alias.SchemaVersion < JOB_SCHEMA_VERSION {
+		var document bson.M
+		if err = raw.Unmarshal(&document); err != nil {
+			return err
+		}
+
+		upgradeJobDocument(document)
+
+		data, err := bson.Marshal(document)
+		if err != nil {
+			return err
+		}
+
+		alias = jobAlias{}
+		if err = bson.Unmarshal(data, &alias); err != nil {
+			return err
+		}
+	}
+
+	*job = Job(alias)
+	return err
+}
+
+//** PRIVATE FUNCTIONS
+
+// init registers the job schema upgrade, it is applied by mongo.MigrateUp
+func init() {
+	mongo.RegisterMigration(mongo.Migration{
+		Namespace:   JOB_MIGRATION_NAMESPACE,
+		Version:     JOB_SCHEMA_MIGRATION,
+		Description: fmt.Sprintf("Upgrade job documents to schema version %d", JOB_SCHEMA_VERSION),
+		Up:          migrateJobs,
+	})
+}
+
+// migrateJobs upgrades job documents written by older versions of this package in place,
+// JOB_MIGRATION_BATCH_SIZE documents at a time
+func migrateJobs(goRoutine string, database *mgo.Database) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "migrateJobs")
+
+	tracelog.Startedf(goRoutine, "migrateJobs", "Database[%s] Version[%d]", database.Name, JOB_SCHEMA_VERSION)
+
+	// Access the jobs collection
+	collection := database.C(JOBS_COLLECTION)
+
+	query := bson.M{"$or": []bson.M{
+		{"schema_version": bson.M{"$exists": false}},
+		{"schema_version": bson.M{"$lt": JOB_SCHEMA_VERSION}},
+	}}
+
+	// Skip documents that fail to upgrade so the loop always makes progress
+	var skipped []interface{}
+	migrated := 0
+
+	for {
+		batchQuery := query
+		if len(skipped) > 0 {
+			batchQuery = bson.M{"$and": []bson.M{query, {"_id": bson.M{"$nin": skipped}}}}
+		}
+
+		var documents []bson.M
+		err = mongo.Retry(goRoutine, database.Session, "migrateJobs", mongo.Instrument(goRoutine, collection, "MigrateJobs", batchQuery, func() error {
+			return collection.Find(batchQuery).Limit(JOB_MIGRATION_BATCH_SIZE).All(&documents)
+		}))
+		if err != nil {
+			tracelog.CompletedError(err, goRoutine, "migrateJobs")
+			return err
+		}
+
+		if len(documents) == 0 {
+			break
+		}
+
+		for _, document := range documents {
+			upgraded, err := migrateJobDocument(goRoutine, collection, document)
+			if err != nil {
+				tracelog.Errorf(err, goRoutine, "migrateJobs", "Id[%v]", document["_id"])
+				skipped = append(skipped, document["_id"])
+				continue
+			}
+
+			if upgraded {
+				migrated++
+			}
+		}
+
+		tracelog.Trace(goRoutine, "migrateJobs", "Info : Batch Complete : Migrated[%d] Skipped[%d]", migrated, len(skipped))
+	}
+
+	tracelog.Completedf(goRoutine, "migrateJobs", "Migrated[%d] Skipped[%d]", migrated, len(skipped))
+	return err
+}
+
+// upgradeJobDocument applies the migrations newer than the document's version
+func upgradeJobDocument(document bson.M) {
+	version := 1
+	switch value := document["schema_version"].(type) {
+	case int:
+		version = value
+	case int64:
+		version = int(value)
+	}
+
+	for _, migration := range jobMigrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		migration.Upgrade(document)
+		document["schema_version"] = migration.Version
+	}
+}
+
+// migrateJobDocument upgrades one document and writes back only the fields that changed,
+// so details added by a running job while the migration runs are not lost
+func migrateJobDocument(goRoutine string, collection *mgo.Collection, document bson.M) (upgraded bool, err error) {
+	original := bson.M{}
+	for key, value := range document {
+		original[key] = value
+	}
+
+	upgradeJobDocument(document)
+
+	set := bson.M{}
+	unset := bson.M{}
+
+	for key, value := range document {
+		if previous, exists := original[key]; !exists || !reflect.DeepEqual(previous, value) {
+			set[key] = value
+		}
+	}
+
+	for key := range original {
+		if _, exists := document[key]; !exists {
+			unset[key] = ""
+		}
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	// Only update the version we read in case another migration got there first
+	query := bson.M{"_id": document["_id"], "schema_version": original["schema_version"]}
+	if _, exists := original["schema_version"]; !exists {
+		query["schema_version"] = bson.M{"$exists": false}
+	}
+
+	err = mongo.Measure(goRoutine, collection, "MigrateJobDocument", query, func() error {
+		return collection.Update(query, update)
+	})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, err
+}
+
+// upgradeJobV2 renames the camel case date fields and sets status on documents written
+// before jobs had one
+func upgradeJobV2(document bson.M) {
+	if value, exists := document["startDate"]; exists {
+		if _, current := document["start_date"]; !current {
+			document["start_date"] = value
+		}
+		delete(document, "startDate")
+	}
+
+	if value, exists := document["endDate"]; exists {
+		document["end_date"] = value
+		delete(document, "endDate")
+	}
+
+	if status, _ := document["status"].(string); status == "" {
+		if _, ended := document["end_date"]; ended {
+			document["status"] = JOB_STATUS_COMPLETED
+		} else {
+			document["status"] = JOB_STATUS_RUNNING
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package data
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//** TESTS
+
+// TestUpgradeJobDocument checks older documents are brought to the current schema version and
+// current documents are left alone
+func TestUpgradeJobDocument(t *testing.T) {
+	started := time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC)
+	ended := started.Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		document bson.M
+		expected bson.M
+	}{
+		{"version 1 running",
+			bson.M{"type": "nightly", "startDate": started},
+			bson.M{"type": "nightly", "start_date": started, "status": JOB_STATUS_RUNNING, "schema_version": 2}},
+		{"version 1 ended",
+			bson.M{"startDate": started, "endDate": ended},
+			bson.M{"start_date": started, "end_date": ended, "status": JOB_STATUS_COMPLETED, "schema_version": 2}},
+		{"version 1 with status",
+			bson.M{"startDate": started, "status": JOB_STATUS_FAILED},
+			bson.M{"start_date": started, "status": JOB_STATUS_FAILED, "schema_version": 2}},
+		{"both start dates",
+			bson.M{"startDate": ended, "start_date": started, "status": JOB_STATUS_RUNNING},
+			bson.M{"start_date": started, "status": JOB_STATUS_RUNNING, "schema_version": 2}},
+		{"explicit version 1",
+			bson.M{"schema_version": int64(1), "startDate": started, "status": JOB_STATUS_RUNNING},
+			bson.M{"start_date": started, "status": JOB_STATUS_RUNNING, "schema_version": 2}},
+		{"current",
+			bson.M{"schema_version": 2, "startDate": started},
+			bson.M{"schema_version": 2, "startDate": started}},
+	}
+
+	for _, test := range tests {
+		upgradeJobDocument(test.document)
+
+		if !reflect.DeepEqual(test.document, test.expected) {
+			t.Errorf("%s : Expected %v, got %v", test.name, test.expected, test.document)
+		}
+	}
+}
+
+// TestJobSetBSON checks a version 1 document decodes into the current job layout
+func TestJobSetBSON(t *testing.T) {
+	started := time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC)
+	jobId := bson.NewObjectId()
+
+	data, err := bson.Marshal(bson.M{"_id": jobId, "type": "nightly", "startDate": started, "endDate": started.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Unable to marshal the document : %s", err)
+	}
+
+	var job Job
+	if err = bson.Unmarshal(data, &job); err != nil {
+		t.Fatalf("Unable to decode the document : %s", err)
+	}
+
+	if job.ObjectId != jobId || job.SchemaVersion != JOB_SCHEMA_VERSION || job.Status != JOB_STATUS_COMPLETED {
+		t.Errorf("Expected an upgraded completed job, got %+v", job)
+	}
+
+	if !job.StartDate.Equal(started) || !job.EndDate.Equal(started.Add(time.Hour)) {
+		t.Errorf("Expected the renamed dates, got %v %v", job.StartDate, job.EndDate)
+	}
+}
@@ -0,0 +1,296 @@
+package data
+
+import (
+	"fmt"
+	"github.com/goinggo/straps"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"sync"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	SLA_BREACH_MAX_DURATION = "max_duration"
+	SLA_BREACH_START_BEFORE = "start_before"
+
+	DEFAULT_SLA_WINDOW = 12 * time.Hour
+)
+
+//** TYPES
+
+type (
+	// SLA contains the expectations for a job type. It is configured with a strap named
+	// sla_<jobType> such as "maxDuration=40m,startBefore=02:00,window=4h,location=America/New_York".
+	SLA struct {
+		JobType     string
+		MaxDuration time.Duration  // The job must end within this long of starting
+		StartBefore time.Duration  // The job must start before this long after midnight
+		Window      time.Duration  // How long before StartBefore the job may start, defaults to 12h
+		Location    *time.Location // The time zone for StartBefore, defaults to local
+	}
+
+	// SLABreach records a missed SLA on the job document
+	SLABreach struct {
+		Type        string    `bson:"type"`
+		Limit       string    `bson:"limit"`
+		OverSeconds float64   `bson:"over_seconds"`
+		Running     bool      `bson:"running"`
+		Date        time.Time `bson:"date"`
+	}
+
+	// slaMonitor alerts when a running job passes its maximum duration
+	slaMonitor struct {
+		shutdown chan struct{}
+		done     chan struct{} // Closed when the monitor goroutine returns
+		once     sync.Once
+		breached bool // Set before done is closed when the running breach was alerted
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// LoadSLA reads the SLA for the job type from straps. A nil SLA is returned when none is configured.
+func LoadSLA(jobType string) (sla *SLA, err error) {
+	settings := ParseLabels(straps.Strap("sla_" + jobType))
+	if len(settings) == 0 {
+		return nil, nil
+	}
+
+	sla = &SLA{
+		JobType:  jobType,
+		Window:   DEFAULT_SLA_WINDOW,
+		Location: time.Local,
+	}
+
+	for key, value := range settings {
+		switch key {
+		case "maxDuration":
+			if sla.MaxDuration, err = time.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("Invalid SLA maxDuration %s For %s : %s", value, jobType, err)
+			}
+
+		case "startBefore":
+			clock, err := time.Parse("15:04", value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid SLA startBefore %s For %s : %s", value, jobType, err)
+			}
+			sla.StartBefore = time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute
+
+		case "window":
+			if sla.Window, err = time.ParseDuration(value); err != nil || sla.Window <= 0 || sla.Window >= 24*time.Hour {
+				return nil, fmt.Errorf("Invalid SLA window %s For %s", value, jobType)
+			}
+
+		case "location":
+			if sla.Location, err = time.LoadLocation(value); err != nil {
+				return nil, fmt.Errorf("Invalid SLA location %s For %s : %s", value, jobType, err)
+			}
+
+		default:
+			return nil, fmt.Errorf("Unknown SLA Setting %s For %s", key, jobType)
+		}
+	}
+
+	return sla, err
+}
+
+//** MEMBER FUNCTIONS
+
+// CheckStart returns a breach if the job started after its StartBefore deadline. A job
+// starting within Window of the next deadline is on time for it, so a nightly job starting
+// at 23:30 meets a 02:00 deadline. Any other start is late for the previous deadline.
+func (sla *SLA) CheckStart(job *Job) *SLABreach {
+	if sla.StartBefore == 0 {
+		return nil
+	}
+
+	window := sla.Window
+	if window <= 0 {
+		window = DEFAULT_SLA_WINDOW
+	}
+
+	start := job.StartDate.In(sla.Location)
+	hour := int(sla.StartBefore / time.Hour)
+	minute := int(sla.StartBefore % time.Hour / time.Minute)
+
+	// The next deadline at or after the start
+	deadline := time.Date(start.Year(), start.Month(), start.Day(), hour, minute, 0, 0, sla.Location)
+	if deadline.Before(start) {
+		deadline = deadline.AddDate(0, 0, 1)
+	}
+
+	if deadline.Sub(start) <= window {
+		return nil
+	}
+
+	deadline = deadline.AddDate(0, 0, -1)
+
+	return &SLABreach{
+		Type:        SLA_BREACH_START_BEFORE,
+		Limit:       deadline.Format("15:04 MST"),
+		OverSeconds: start.Sub(deadline).Seconds(),
+		Date:        time.Now(),
+	}
+}
+
+// CheckDuration returns a breach if the job ran longer than MaxDuration. Pass the zero
+// time to check a job that has ended, or the current time to check a running job.
+func (sla *SLA) CheckDuration(job *Job, now time.Time) *SLABreach {
+	if sla.MaxDuration == 0 {
+		return nil
+	}
+
+	running := !now.IsZero()
+	end := job.EndDate
+	if running {
+		end = now
+	}
+
+	over := end.Sub(job.StartDate) - sla.MaxDuration
+	if over <= 0 {
+		return nil
+	}
+
+	return &SLABreach{
+		Type:        SLA_BREACH_MAX_DURATION,
+		Limit:       sla.MaxDuration.String(),
+		OverSeconds: over.Seconds(),
+		Running:     running,
+		Date:        time.Now(),
+	}
+}
+
+// String describes the breach for alerts and logs
+func (breach *SLABreach) String() string {
+	over := time.Duration(breach.OverSeconds * float64(time.Second)).Round(time.Second)
+
+	switch breach.Type {
+	case SLA_BREACH_START_BEFORE:
+		return fmt.Sprintf("Job started %v after the %s start deadline", over, breach.Limit)
+
+	case SLA_BREACH_MAX_DURATION:
+		if breach.Running {
+			return fmt.Sprintf("Job is still running %v over the %s maximum duration", over, breach.Limit)
+		}
+		return fmt.Sprintf("Job finished %v over the %s maximum duration", over, breach.Limit)
+	}
+
+	return fmt.Sprintf("%s breach of %s by %v", breach.Type, breach.Limit, over)
+}
+
+// stop ends the monitor. It is safe to call more than once.
+func (monitor *slaMonitor) stop() {
+	monitor.once.Do(func() {
+		close(monitor.shutdown)
+	})
+}
+
+//** PRIVATE FUNCTIONS
+
+// startSLA checks the start deadline of a job that just started and watches its duration
+func startSLA(goRoutine string, useSession string, useDatabase string, job *Job) {
+	sla, err := LoadSLA(job.Type)
+	if err != nil {
+		tracelog.Warning(goRoutine, "startSLA", "%s", err)
+		return
+	}
+
+	if sla == nil {
+		return
+	}
+
+	if breach := sla.CheckStart(job); breach != nil {
+		recordSLABreach(goRoutine, useSession, useDatabase, job, breach, true)
+	}
+
+	if sla.MaxDuration == 0 {
+		return
+	}
+
+	monitor := &slaMonitor{shutdown: make(chan struct{}), done: make(chan struct{})}
+	job.slaMonitor = monitor
+
+	// The monitor works on a copy since endJob changes the job while it runs
+	started := *job
+
+	go func() {
+		defer close(monitor.done)
+
+		timer := time.NewTimer(started.StartDate.Add(sla.MaxDuration).Sub(time.Now()))
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			if breach := sla.CheckDuration(&started, time.Now()); breach != nil {
+				monitor.breached = recordSLABreach(goRoutine, useSession, useDatabase, &started, breach, true) == nil
+			}
+
+		case <-monitor.shutdown:
+		}
+	}()
+}
+
+// endSLA stops the running monitor and checks the final duration of a job that ended. The
+// final breach is recorded without a second alert when the running breach was already sent.
+func endSLA(goRoutine string, useSession string, useDatabase string, job *Job) {
+	alerted := false
+
+	if job.slaMonitor != nil {
+		job.slaMonitor.stop()
+		<-job.slaMonitor.done
+		alerted = job.slaMonitor.breached
+	}
+
+	sla, err := LoadSLA(job.Type)
+	if err != nil || sla == nil {
+		return
+	}
+
+	if breach := sla.CheckDuration(job, time.Time{}); breach != nil {
+		recordSLABreach(goRoutine, useSession, useDatabase, job, breach, !alerted)
+	}
+}
+
+// recordSLABreach adds the breach to the job document and sends an alert if asked to
+func recordSLABreach(goRoutine string, useSession string, useDatabase string, job *Job, breach *SLABreach, alert bool) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "recordSLABreach")
+
+	tracelog.Startedf(goRoutine, "recordSLABreach", "Id[%v] Type[%s] Breach[%s]", job.ObjectId, job.Type, breach)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "recordSLABreach")
+		return err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the jobs collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "recordSLABreach")
+		return err
+	}
+
+	err = mongo.Measure(goRoutine, collection, "RecordSLABreach", bson.M{"_id": job.ObjectId}, func() error {
+		return collection.UpdateId(job.ObjectId, bson.M{"$push": bson.M{"sla_breaches": breach}})
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "recordSLABreach")
+		return err
+	}
+
+	if alert {
+		subject := fmt.Sprintf("SLA Breach %s", strings.Replace(breach.Type, "_", " ", -1))
+		SendJobAlert(goRoutine, job, subject, breach.String())
+	}
+
+	tracelog.Completed(goRoutine, "recordSLABreach")
+	return err
+}
@@ -0,0 +1,102 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+//** TESTS
+
+// TestSLACheckStart checks starts within the window before the deadline are on time and any
+// other start is late for the previous deadline
+func TestSLACheckStart(t *testing.T) {
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		start  time.Time
+		over   time.Duration // Expected lateness, on time when zero
+	}{
+		{"before the deadline", 0, at(2, 1, 30), 0},
+		{"at the deadline", 0, at(2, 2, 0), 0},
+		{"the evening before", 0, at(1, 23, 30), 0},
+		{"at the window", 0, at(1, 14, 0), 0},
+		{"after the deadline", 0, at(2, 2, 30), 30 * time.Minute},
+		{"before the window", 0, at(2, 13, 59), 11*time.Hour + 59*time.Minute},
+		{"before a short window", 4 * time.Hour, at(1, 21, 0), 19 * time.Hour},
+		{"within a short window", 4 * time.Hour, at(1, 22, 0), 0},
+	}
+
+	for _, test := range tests {
+		sla := &SLA{JobType: "nightly", StartBefore: 2 * time.Hour, Window: test.window, Location: time.UTC}
+
+		breach := sla.CheckStart(&Job{StartDate: test.start})
+
+		if test.over == 0 {
+			if breach != nil {
+				t.Errorf("%s : Expected no breach, got %s", test.name, breach)
+			}
+			continue
+		}
+
+		if breach == nil {
+			t.Errorf("%s : Expected a breach", test.name)
+			continue
+		}
+
+		if breach.Type != SLA_BREACH_START_BEFORE || breach.Limit != "02:00 UTC" || breach.OverSeconds != test.over.Seconds() {
+			t.Errorf("%s : Expected %v late for 02:00 UTC, got %+v", test.name, test.over, breach)
+		}
+	}
+
+	// Without a deadline there is nothing to check
+	if breach := (&SLA{Location: time.UTC}).CheckStart(&Job{StartDate: at(2, 12, 0)}); breach != nil {
+		t.Errorf("Expected no breach without a deadline, got %s", breach)
+	}
+}
+
+// TestSLACheckDuration checks ended and running jobs against the maximum duration
+func TestSLACheckDuration(t *testing.T) {
+	start := time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		maxDuration time.Duration
+		end         time.Time
+		now         time.Time
+		over        time.Duration // Expected overrun, none when zero
+	}{
+		{"ended in time", 40 * time.Minute, start.Add(30 * time.Minute), time.Time{}, 0},
+		{"ended at the limit", 40 * time.Minute, start.Add(40 * time.Minute), time.Time{}, 0},
+		{"ended late", 40 * time.Minute, start.Add(50 * time.Minute), time.Time{}, 10 * time.Minute},
+		{"running in time", 40 * time.Minute, time.Time{}, start.Add(20 * time.Minute), 0},
+		{"running late", 40 * time.Minute, time.Time{}, start.Add(45 * time.Minute), 5 * time.Minute},
+		{"no limit", 0, start.Add(10 * time.Hour), time.Time{}, 0},
+	}
+
+	for _, test := range tests {
+		sla := &SLA{JobType: "nightly", MaxDuration: test.maxDuration}
+
+		breach := sla.CheckDuration(&Job{StartDate: start, EndDate: test.end}, test.now)
+
+		if test.over == 0 {
+			if breach != nil {
+				t.Errorf("%s : Expected no breach, got %s", test.name, breach)
+			}
+			continue
+		}
+
+		if breach == nil {
+			t.Errorf("%s : Expected a breach", test.name)
+			continue
+		}
+
+		running := !test.now.IsZero()
+		if breach.Type != SLA_BREACH_MAX_DURATION || breach.Limit != test.maxDuration.String() || breach.OverSeconds != test.over.Seconds() || breach.Running != running {
+			t.Errorf("%s : Expected %v over with running %v, got %+v", test.name, test.over, running, breach)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/goinggo/straps"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	htmltemplate "html/template"
+	"sort"
+	"sync"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	SUMMARY_POLICY_NEVER    = "never"
+	SUMMARY_POLICY_ALWAYS   = "always"
+	SUMMARY_POLICY_FAILURE  = "failure"
+	SUMMARY_POLICY_WARNINGS = "warnings"
+
+	// SUMMARY_PHASE_STARTUP names the time from the job start to its first detail
+	SUMMARY_PHASE_STARTUP = "Startup"
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	runJobs      []*Job     // Jobs started by this program that want a summary
+	runJobsMutex sync.Mutex // Protects the runJobs slice
+
+	summaryTemplate = htmltemplate.Must(htmltemplate.New("summary").Parse(summaryScript()))
+)
+
+//** TYPES
+
+type (
+	// SummaryPhase is the time spent between one job detail and the next
+	SummaryPhase struct {
+		Task     string
+		Details  string
+		Start    time.Time
+		Duration time.Duration
+		Percent  float64 // Share of the whole run, used to draw the timeline
+		Warning  bool
+	}
+
+	// SummaryCount is the number of details recorded for a task
+	SummaryCount struct {
+		Task  string
+		Count int
+	}
+
+	// JobSummary is the end of run report for a job
+	JobSummary struct {
+		Job      *Job
+		Duration time.Duration
+		Phases   []SummaryPhase
+		Counts   []SummaryCount
+		Warnings []string
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// SummaryPolicy returns when a summary is sent for the job type. It is configured with a
+// strap named summary_<jobType>, falling back to the summaryPolicy strap, and is one of
+// always, failure, warnings or never. The warnings policy also sends on failure.
+func SummaryPolicy(jobType string) string {
+	policy := straps.Strap("summary_" + jobType)
+	if policy == "" {
+		policy = straps.Strap("summaryPolicy")
+	}
+
+	switch policy {
+	case SUMMARY_POLICY_ALWAYS, SUMMARY_POLICY_FAILURE, SUMMARY_POLICY_WARNINGS:
+		return policy
+	}
+
+	return SUMMARY_POLICY_NEVER
+}
+
+// NewJobSummary builds the report for the job from its details
+func NewJobSummary(job *Job) *JobSummary {
+	jobSummary := &JobSummary{
+		Job: job,
+	}
+
+	end := job.EndDate
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	jobSummary.Duration = end.Sub(job.StartDate).Round(time.Second)
+
+	for _, breach := range job.SLABreaches {
+		jobSummary.Warnings = append(jobSummary.Warnings, breach.String())
+	}
+
+	details := make([]JobDetail, len(job.Details))
+	copy(details, job.Details)
+	sort.SliceStable(details, func(i int, j int) bool {
+		return details[i].Date.Before(details[j].Date)
+	})
+
+	counts := map[string]int{}
+
+	total := end.Sub(job.StartDate)
+
+	// The time before the first detail is its own phase
+	startupEnd := end
+	if len(details) > 0 {
+		startupEnd = details[0].Date
+	}
+
+	if startup := startupEnd.Sub(job.StartDate); startup > 0 {
+		phase := SummaryPhase{
+			Task:     SUMMARY_PHASE_STARTUP,
+			Start:    job.StartDate,
+			Duration: startup.Round(time.Millisecond),
+		}
+
+		if total > 0 {
+			phase.Percent = float64(phase.Duration) / float64(total) * 100
+		}
+
+		jobSummary.Phases = append(jobSummary.Phases, phase)
+	}
+
+	// Each detail starts a phase that runs until the next detail or the end of the job
+	for index, detail := range details {
+		phaseEnd := end
+		if index+1 < len(details) {
+			phaseEnd = details[index+1].Date
+		}
+
+		phase := SummaryPhase{
+			Task:     detail.Task,
+			Details:  detail.Details,
+			Start:    detail.Date,
+			Duration: phaseEnd.Sub(detail.Date).Round(time.Millisecond),
+			Warning:  detail.reportsWarning(),
+		}
+
+		if total > 0 {
+			phase.Percent = float64(phase.Duration) / float64(total) * 100
+		}
+
+		if phase.Warning {
+			jobSummary.Warnings = append(jobSummary.Warnings, fmt.Sprintf("%s: %s", detail.Task, detail.Details))
+		}
+
+		jobSummary.Phases = append(jobSummary.Phases, phase)
+		counts[detail.Task]++
+	}
+
+	for task, count := range counts {
+		jobSummary.Counts = append(jobSummary.Counts, SummaryCount{Task: task, Count: count})
+	}
+
+	sort.Slice(jobSummary.Counts, func(i int, j int) bool {
+		return jobSummary.Counts[i].Task < jobSummary.Counts[j].Task
+	})
+
+	return jobSummary
+}
+
+// SendRunSummaries emails a summary for each job this program started, according to the
+// summary policy of its type. It is called by the controller at the end of the run.
+func SendRunSummaries(goRoutine string) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "SendRunSummaries")
+
+	runJobsMutex.Lock()
+	jobs := runJobs
+	runJobs = nil
+	runJobsMutex.Unlock()
+
+	tracelog.Startedf(goRoutine, "SendRunSummaries", "Jobs[%d]", len(jobs))
+
+	// Summaries are optional for programs that never configured email
+	if helper.EmailHost == "" {
+		tracelog.Completedf(goRoutine, "SendRunSummaries", "Email Not Configured")
+		return err
+	}
+
+	for _, job := range jobs {
+		jobSummary := NewJobSummary(job)
+		if !jobSummary.Wanted(SummaryPolicy(job.Type)) {
+			continue
+		}
+
+		html, sendErr := jobSummary.HTML()
+		if sendErr == nil {
+			sendErr = helper.SendEmail(goRoutine, jobSummary.Subject(), html)
+		}
+
+		if sendErr != nil {
+			tracelog.Errorf(sendErr, goRoutine, "SendRunSummaries", "Id[%v]", job.ObjectId)
+			err = sendErr
+		}
+	}
+
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "SendRunSummaries")
+		return err
+	}
+
+	tracelog.Completed(goRoutine, "SendRunSummaries")
+	return err
+}
+
+//** MEMBER FUNCTIONS
+
+// Failed returns true if the job failed or never finished
+func (jobSummary *JobSummary) Failed() bool {
+	return jobSummary.Job.Status != JOB_STATUS_COMPLETED
+}
+
+// Wanted returns true if the policy calls for this summary to be sent
+func (jobSummary *JobSummary) Wanted(policy string) bool {
+	switch policy {
+	case SUMMARY_POLICY_ALWAYS:
+		return true
+
+	case SUMMARY_POLICY_FAILURE:
+		return jobSummary.Failed()
+
+	case SUMMARY_POLICY_WARNINGS:
+		return jobSummary.Failed() || len(jobSummary.Warnings) > 0
+	}
+
+	return false
+}
+
+// Subject returns a subject line for emailing the summary
+func (jobSummary *JobSummary) Subject() string {
+	status := "Completed"
+	switch {
+	case jobSummary.Job.Status == JOB_STATUS_FAILED:
+		status = "Failed"
+	case jobSummary.Failed():
+		status = "Did Not Finish"
+	case len(jobSummary.Warnings) > 0:
+		status = fmt.Sprintf("Completed With %d Warnings", len(jobSummary.Warnings))
+	}
+
+	subject := fmt.Sprintf("Run Summary : %s", jobSummary.Job.Type)
+	if len(jobSummary.Job.Labels) > 0 {
+		subject = fmt.Sprintf("%s [%s]", subject, jobSummary.Job.Labels)
+	}
+
+	return fmt.Sprintf("%s : %s", subject, status)
+}
+
+// HTML renders the summary as an html fragment suitable for helper.SendEmail
+func (jobSummary *JobSummary) HTML() (html string, err error) {
+	buffer := new(bytes.Buffer)
+	if err = summaryTemplate.Execute(buffer, jobSummary); err != nil {
+		return html, err
+	}
+
+	return buffer.String(), err
+}
+
+//** PRIVATE FUNCTIONS
+
+// trackRunJob remembers a job started by this program if its type wants a summary
+func trackRunJob(job *Job) {
+	if SummaryPolicy(job.Type) == SUMMARY_POLICY_NEVER {
+		return
+	}
+
+	runJobsMutex.Lock()
+	runJobs = append(runJobs, job)
+	runJobsMutex.Unlock()
+}
+
+// forgetRunJob drops a job that was given back to the queue so no summary is sent for it
+func forgetRunJob(job *Job) {
+	runJobsMutex.Lock()
+	defer runJobsMutex.Unlock()
+
+	for index, runJob := range runJobs {
+		if runJob.ObjectId == job.ObjectId {
+			runJobs = append(runJobs[:index], runJobs[index+1:]...)
+			return
+		}
+	}
+}
+
+// captureRunJob reloads an ended job with its details so the summary can be built after
+// the program has shut down its mongo sessions
+func captureRunJob(goRoutine string, collection *mgo.Collection, job *Job) {
+	if !isRunJob(job.ObjectId) {
+		return
+	}
+
+	// Read the document without holding the lock so ending jobs do not wait on each other
+	ended := &Job{}
+	err := mongo.Measure(goRoutine, collection, "CaptureRunJob", bson.M{"_id": job.ObjectId}, func() error {
+		return collection.FindId(job.ObjectId).One(ended)
+	})
+	if err != nil {
+		tracelog.Errorf(err, goRoutine, "captureRunJob", "Id[%v]", job.ObjectId)
+		return
+	}
+
+	runJobsMutex.Lock()
+	defer runJobsMutex.Unlock()
+
+	for index, runJob := range runJobs {
+		if runJob.ObjectId == job.ObjectId {
+			runJobs[index] = ended
+			return
+		}
+	}
+}
+
+// isRunJob returns true if the job is tracked for the end of run summary
+func isRunJob(jobId bson.ObjectId) bool {
+	runJobsMutex.Lock()
+	defer runJobsMutex.Unlock()
+
+	for _, runJob := range runJobs {
+		if runJob.ObjectId == jobId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// summaryScript returns the template for the summary email
+func summaryScript() string {
+	return `<h3>Run Summary : {{.Job.Type}} {{.Job.Labels}}</h3>
+Job: {{.Job.ObjectId.Hex}}<br />
+Status: {{.Job.Status}}<br />
+Started: {{.Job.StartDate.Format "2006-01-02 15:04:05 MST"}}<br />
+Duration: {{.Duration}}<br />
+{{if .Job.Result}}Result: {{.Job.Result}}<br />{{end}}
+{{if .Job.Host}}Host: {{.Job.Host.Hostname}} (pid {{.Job.Host.PID}}) {{.Job.Host.Environment}}<br />{{end}}
+<h4>Timeline</h4>
+<table border="0" cellpadding="2" cellspacing="0" width="100%">
+{{range .Phases}}<tr>
+<td nowrap>{{.Start.Format "15:04:05"}}</td>
+<td nowrap>{{if .Warning}}<b>{{.Task}}</b>{{else}}{{.Task}}{{end}}</td>
+<td nowrap>{{.Duration}}</td>
+<td width="60%"><div style="background:{{if .Warning}}#d9534f{{else}}#5bc0de{{end}};width:{{printf "%.1f" .Percent}}%;height:10px"></div></td>
+<td>{{.Details}}</td>
+</tr>
+{{end}}</table>
+<h4>Counts</h4>
+{{range .Counts}}{{.Task}}: {{.Count}}<br />
+{{end}}
+<h4>Warnings</h4>
+{{range .Warnings}}{{.}}<br />
+{{else}}None<br />
+{{end}}`
+}
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//** TESTS
+
+// TestNewJobSummary checks the timeline phases, counts and warnings built from the details
+func TestNewJobSummary(t *testing.T) {
+	started := time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC)
+	minute := func(minutes int) time.Time {
+		return started.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	tests := []struct {
+		name     string
+		job      Job
+		phases   []SummaryPhase
+		counts   []SummaryCount
+		warnings []string
+	}{
+		{"no details",
+			Job{StartDate: started, EndDate: minute(5)},
+			[]SummaryPhase{{Task: SUMMARY_PHASE_STARTUP, Start: started, Duration: 5 * time.Minute, Percent: 100}},
+			nil, nil},
+		{"details out of order",
+			Job{StartDate: started, EndDate: minute(5), Details: []JobDetail{
+				{Task: "save", Date: minute(3), Details: "Warning: slow disk"},
+				{Task: "load", Date: minute(1), Details: "Loaded"},
+			}},
+			[]SummaryPhase{
+				{Task: SUMMARY_PHASE_STARTUP, Start: started, Duration: time.Minute, Percent: 20},
+				{Task: "load", Details: "Loaded", Start: minute(1), Duration: 2 * time.Minute, Percent: 40},
+				{Task: "save", Details: "Warning: slow disk", Start: minute(3), Duration: 2 * time.Minute, Percent: 40, Warning: true},
+			},
+			[]SummaryCount{{Task: "load", Count: 1}, {Task: "save", Count: 1}},
+			[]string{"save: Warning: slow disk"}},
+		{"breach and repeated task",
+			Job{StartDate: started, EndDate: minute(4), SLABreaches: []SLABreach{{Type: SLA_BREACH_MAX_DURATION, Limit: "2m0s", OverSeconds: 120}}, Details: []JobDetail{
+				{Task: "load", Date: started, Details: "Loaded"},
+				{Task: "load", Date: minute(2), Details: "Failed to load row"},
+			}},
+			[]SummaryPhase{
+				{Task: "load", Details: "Loaded", Start: started, Duration: 2 * time.Minute, Percent: 50},
+				{Task: "load", Details: "Failed to load row", Start: minute(2), Duration: 2 * time.Minute, Percent: 50, Warning: true},
+			},
+			[]SummaryCount{{Task: "load", Count: 2}},
+			[]string{"Job finished 2m0s over the 2m0s maximum duration", "load: Failed to load row"}},
+	}
+
+	for _, test := range tests {
+		jobSummary := NewJobSummary(&test.job)
+
+		if jobSummary.Duration != test.job.EndDate.Sub(started) {
+			t.Errorf("%s : Expected a duration of %v, got %v", test.name, test.job.EndDate.Sub(started), jobSummary.Duration)
+		}
+
+		if !reflect.DeepEqual(jobSummary.Phases, test.phases) {
+			t.Errorf("%s : Expected phases\n%+v\ngot\n%+v", test.name, test.phases, jobSummary.Phases)
+		}
+
+		if !reflect.DeepEqual(jobSummary.Counts, test.counts) {
+			t.Errorf("%s : Expected counts %v, got %v", test.name, test.counts, jobSummary.Counts)
+		}
+
+		if !reflect.DeepEqual(jobSummary.Warnings, test.warnings) {
+			t.Errorf("%s : Expected warnings %q, got %q", test.name, test.warnings, jobSummary.Warnings)
+		}
+	}
+}
+
+// TestJobSummaryWanted checks each policy against completed, warned and failed runs
+func TestJobSummaryWanted(t *testing.T) {
+	completed := &JobSummary{Job: &Job{Status: JOB_STATUS_COMPLETED}}
+	warned := &JobSummary{Job: &Job{Status: JOB_STATUS_COMPLETED}, Warnings: []string{"load: Warning"}}
+	failed := &JobSummary{Job: &Job{Status: JOB_STATUS_FAILED}}
+	unfinished := &JobSummary{Job: &Job{Status: JOB_STATUS_RUNNING}}
+
+	tests := []struct {
+		policy string
+		wanted []bool // For completed, warned, failed and unfinished runs
+	}{
+		{SUMMARY_POLICY_ALWAYS, []bool{true, true, true, true}},
+		{SUMMARY_POLICY_FAILURE, []bool{false, false, true, true}},
+		{SUMMARY_POLICY_WARNINGS, []bool{false, true, true, true}},
+		{SUMMARY_POLICY_NEVER, []bool{false, false, false, false}},
+	}
+
+	for _, test := range tests {
+		for index, jobSummary := range []*JobSummary{completed, warned, failed, unfinished} {
+			if wanted := jobSummary.Wanted(test.policy); wanted != test.wanted[index] {
+				t.Errorf("%s : Expected %v for %s with %d warnings, got %v", test.policy, test.wanted[index], jobSummary.Job.Status, len(jobSummary.Warnings), wanted)
+			}
+		}
+	}
+}
+
+// TestJobSummaryHTML checks the summary renders with its warnings
+func TestJobSummaryHTML(t *testing.T) {
+	started := time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC)
+
+	jobSummary := NewJobSummary(&Job{Type: "nightly", Status: JOB_STATUS_COMPLETED, StartDate: started, EndDate: started.Add(time.Minute), Details: []JobDetail{
+		{Task: "save", Date: started, Details: "Warning: <slow> disk"},
+	}})
+
+	html, err := jobSummary.HTML()
+	if err != nil {
+		t.Fatalf("Unable to render the summary : %s", err)
+	}
+
+	if !strings.Contains(html, "Run Summary : nightly") || !strings.Contains(html, "save: Warning: &lt;slow&gt; disk") {
+		t.Errorf("Expected the escaped warning in the summary, got\n%s", html)
+	}
+}
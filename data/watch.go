@@ -0,0 +1,567 @@
+package data
+
+import (
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	JOB_EVENT_INSERT = "insert"
+	JOB_EVENT_STATUS = "status"
+	JOB_EVENT_DETAIL = "detail"
+
+	WATCH_POLL_INTERVAL = 5 * time.Second
+	WATCH_RETRY_DELAY   = 2 * time.Second
+	WATCH_MAX_AWAIT_MS  = 1000
+	WATCH_EVENT_BUFFER  = 100
+)
+
+//** TYPES
+
+type (
+	// JobEvent describes a change to a job document
+	JobEvent struct {
+		Type        string        // JOB_EVENT_INSERT, JOB_EVENT_STATUS or JOB_EVENT_DETAIL
+		JobId       bson.ObjectId // The job that changed
+		Job         *Job          // The job document after the change when available, without details when polling
+		Status      string        // The new status for status events
+		Details     []JobDetail   // The new details for detail events
+		ResumeToken bson.Raw      // Pass to Watch to continue after this event, empty when polling
+	}
+
+	// JobWatcher streams job events from a change stream, or by polling when
+	// the server does not support change streams
+	JobWatcher struct {
+		goRoutine   string
+		useSession  string
+		useDatabase string
+		events      chan JobEvent
+		shutdown    chan struct{}
+		closeOnce   sync.Once
+
+		mutex       sync.Mutex
+		resumeToken bson.Raw
+		polling     bool
+		err         error
+
+		// Details seen per job on the change stream, only used by the stream goroutine
+		detailCounts map[bson.ObjectId]int
+	}
+
+	// changeEvent is the document returned by a change stream
+	changeEvent struct {
+		ResumeToken       bson.Raw `bson:"_id"`
+		OperationType     string   `bson:"operationType"`
+		FullDocument      *Job     `bson:"fullDocument"`
+		DocumentKey       bson.M   `bson:"documentKey"`
+		UpdateDescription struct {
+			UpdatedFields bson.Raw `bson:"updatedFields"`
+		} `bson:"updateDescription"`
+	}
+
+	// changeCursor is the cursor returned by the aggregate and getMore commands
+	changeCursor struct {
+		Cursor struct {
+			Id         int64      `bson:"id"`
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			NextBatch  []bson.Raw `bson:"nextBatch"`
+		} `bson:"cursor"`
+	}
+
+	// polledJob is what the polling fallback remembers about a job
+	polledJob struct {
+		ObjectId bson.ObjectId `bson:"_id"`
+		Status   string        `bson:"status"`
+		Details  int           `bson:"details"` // The number of details recorded
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// Watch starts streaming job inserts, status changes and new details. Pass the
+// ResumeToken of the last event received to continue where a previous watcher
+// left off, or nil to start from now. Standalone servers are polled instead.
+func Watch(goRoutine string, useSession string, useDatabase string, resumeToken bson.Raw) (jobWatcher *JobWatcher, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "Watch")
+
+	tracelog.Startedf(goRoutine, "Watch", "UseSession[%s] UseDatabase[%s] Resume[%v]", useSession, useDatabase, resumeToken.Kind != 0)
+
+	jobWatcher = &JobWatcher{
+		goRoutine:   goRoutine,
+		useSession:  useSession,
+		useDatabase: useDatabase,
+		events:      make(chan JobEvent, WATCH_EVENT_BUFFER),
+		shutdown:    make(chan struct{}),
+		resumeToken: resumeToken,
+
+		detailCounts: map[bson.ObjectId]int{},
+	}
+
+	// Open the first cursor here so configuration problems are reported to the caller
+	cursorId, batch, err := jobWatcher.openChangeStream()
+	if err != nil {
+		if !changeStreamsUnsupported(err) {
+			tracelog.CompletedError(err, goRoutine, "Watch")
+			return nil, err
+		}
+
+		tracelog.Warning(goRoutine, "Watch", "Change Streams Unsupported, Polling : %s", err)
+		jobWatcher.polling = true
+
+		go jobWatcher.poll()
+
+		tracelog.Completed(goRoutine, "Watch")
+		return jobWatcher, nil
+	}
+
+	go jobWatcher.stream(cursorId, batch)
+
+	tracelog.Completed(goRoutine, "Watch")
+	return jobWatcher, nil
+}
+
+//** MEMBER FUNCTIONS
+
+// Events returns the channel of job events. It is closed when the watcher stops.
+func (jobWatcher *JobWatcher) Events() <-chan JobEvent {
+	return jobWatcher.events
+}
+
+// ResumeToken returns the token of the last event delivered
+func (jobWatcher *JobWatcher) ResumeToken() bson.Raw {
+	jobWatcher.mutex.Lock()
+	defer jobWatcher.mutex.Unlock()
+
+	return jobWatcher.resumeToken
+}
+
+// Polling returns true when the watcher fell back to polling
+func (jobWatcher *JobWatcher) Polling() bool {
+	return jobWatcher.polling
+}
+
+// Err returns the error that stopped the watcher, if any
+func (jobWatcher *JobWatcher) Err() error {
+	jobWatcher.mutex.Lock()
+	defer jobWatcher.mutex.Unlock()
+
+	return jobWatcher.err
+}
+
+// Close stops the watcher. The events channel is closed once the watcher exits.
+func (jobWatcher *JobWatcher) Close() {
+	jobWatcher.closeOnce.Do(func() {
+		close(jobWatcher.shutdown)
+	})
+}
+
+// stream reads the change stream and reconnects from the last resume token on failure
+func (jobWatcher *JobWatcher) stream(cursorId int64, batch []bson.Raw) {
+	defer close(jobWatcher.events)
+
+	for {
+		err := jobWatcher.drain(cursorId, batch)
+
+		select {
+		case <-jobWatcher.shutdown:
+			return
+		default:
+		}
+
+		tracelog.Warning(jobWatcher.goRoutine, "JobWatcher.stream", "Change Stream Lost, Resuming : %s", err)
+
+		// Reconnect from the last event we delivered
+		for {
+			select {
+			case <-jobWatcher.shutdown:
+				return
+			case <-time.After(WATCH_RETRY_DELAY):
+			}
+
+			cursorId, batch, err = jobWatcher.openChangeStream()
+			if err == nil {
+				break
+			}
+
+			// The resume token is no longer in the oplog so events were lost
+			if queryError, ok := err.(*mgo.QueryError); ok && queryError.Code == 286 {
+				jobWatcher.setErr(err)
+				return
+			}
+
+			tracelog.Error(err, jobWatcher.goRoutine, "JobWatcher.stream")
+		}
+	}
+}
+
+// drain delivers events from the cursor until it fails or the watcher is closed
+func (jobWatcher *JobWatcher) drain(cursorId int64, batch []bson.Raw) (err error) {
+	defer helper.CatchPanic(&err, jobWatcher.goRoutine, "JobWatcher.drain")
+
+	mongoSession, err := mongo.CopySession(jobWatcher.goRoutine, jobWatcher.useSession)
+	if err != nil {
+		return err
+	}
+
+	defer mongo.CloseSession(jobWatcher.goRoutine, mongoSession)
+
+	database := mongoSession.DB(jobWatcher.useDatabase)
+
+	for {
+		for _, raw := range batch {
+			var change changeEvent
+			if err = raw.Unmarshal(&change); err != nil {
+				return err
+			}
+
+			if !jobWatcher.deliver(change) {
+				database.Run(bson.D{{Name: "killCursors", Value: JOBS_COLLECTION}, {Name: "cursors", Value: []int64{cursorId}}}, nil)
+				return nil
+			}
+		}
+
+		select {
+		case <-jobWatcher.shutdown:
+			database.Run(bson.D{{Name: "killCursors", Value: JOBS_COLLECTION}, {Name: "cursors", Value: []int64{cursorId}}}, nil)
+			return nil
+		default:
+		}
+
+		var result changeCursor
+		command := bson.D{
+			{Name: "getMore", Value: cursorId},
+			{Name: "collection", Value: JOBS_COLLECTION},
+			{Name: "maxTimeMS", Value: WATCH_MAX_AWAIT_MS},
+		}
+
+		if err = database.Run(command, &result); err != nil {
+			return err
+		}
+
+		cursorId = result.Cursor.Id
+		batch = result.Cursor.NextBatch
+	}
+}
+
+// deliver converts a change into job events and sends them. Returns false if the watcher was closed.
+func (jobWatcher *JobWatcher) deliver(change changeEvent) bool {
+	jobId, _ := change.DocumentKey["_id"].(bson.ObjectId)
+
+	var events []JobEvent
+
+	switch change.OperationType {
+	case "insert":
+		events = append(events, JobEvent{Type: JOB_EVENT_INSERT, JobId: jobId, Job: change.FullDocument})
+
+		if change.FullDocument != nil {
+			jobWatcher.detailCounts[jobId] = len(change.FullDocument.Details)
+		}
+
+	case "update", "replace":
+		var updated bson.RawD
+		change.UpdateDescription.UpdatedFields.Unmarshal(&updated)
+
+		var details []JobDetail
+		for _, field := range updated {
+			switch {
+			case field.Name == "status":
+				var status string
+				field.Value.Unmarshal(&status)
+				events = append(events, JobEvent{Type: JOB_EVENT_STATUS, JobId: jobId, Job: change.FullDocument, Status: status})
+
+			// The whole array was written so only the entries past the ones already seen are new
+			case field.Name == "details":
+				var all []JobDetail
+				field.Value.Unmarshal(&all)
+
+				if known := jobWatcher.detailCounts[jobId]; len(all) > known {
+					details = append(details, all[known:]...)
+				}
+
+				jobWatcher.detailCounts[jobId] = len(all)
+
+			case strings.HasPrefix(field.Name, "details."):
+				index, err := strconv.Atoi(strings.TrimPrefix(field.Name, "details."))
+				if err != nil {
+					continue
+				}
+
+				var detail JobDetail
+				if field.Value.Unmarshal(&detail) == nil && index >= jobWatcher.detailCounts[jobId] {
+					details = append(details, detail)
+					jobWatcher.detailCounts[jobId] = index + 1
+				}
+			}
+		}
+
+		if len(details) > 0 {
+			events = append(events, JobEvent{Type: JOB_EVENT_DETAIL, JobId: jobId, Job: change.FullDocument, Details: details})
+		}
+
+		// Details are written before a job ends so finished jobs are no longer counted
+		for _, event := range events {
+			if event.Status == JOB_STATUS_COMPLETED || event.Status == JOB_STATUS_FAILED {
+				delete(jobWatcher.detailCounts, jobId)
+			}
+		}
+
+	case "delete":
+		delete(jobWatcher.detailCounts, jobId)
+	}
+
+	for _, event := range events {
+		event.ResumeToken = change.ResumeToken
+
+		select {
+		case jobWatcher.events <- event:
+		case <-jobWatcher.shutdown:
+			return false
+		}
+	}
+
+	// Events are delivered so this is where a new watcher should pick up
+	jobWatcher.mutex.Lock()
+	jobWatcher.resumeToken = change.ResumeToken
+	jobWatcher.mutex.Unlock()
+
+	return true
+}
+
+// openChangeStream runs the aggregate command that opens the change stream cursor
+func (jobWatcher *JobWatcher) openChangeStream() (cursorId int64, batch []bson.Raw, err error) {
+	mongoSession, err := mongo.CopySession(jobWatcher.goRoutine, jobWatcher.useSession)
+	if err != nil {
+		return cursorId, batch, err
+	}
+
+	defer mongo.CloseSession(jobWatcher.goRoutine, mongoSession)
+
+	options := bson.M{"fullDocument": "updateLookup"}
+	if resumeToken := jobWatcher.ResumeToken(); resumeToken.Kind != 0 {
+		options["resumeAfter"] = resumeToken
+	}
+
+	command := bson.D{
+		{Name: "aggregate", Value: JOBS_COLLECTION},
+		{Name: "pipeline", Value: []bson.M{{"$changeStream": options}}},
+		{Name: "cursor", Value: bson.M{}},
+	}
+
+	var result changeCursor
+	if err = mongoSession.DB(jobWatcher.useDatabase).Run(command, &result); err != nil {
+		return cursorId, batch, err
+	}
+
+	return result.Cursor.Id, result.Cursor.FirstBatch, err
+}
+
+// poll compares the jobs collection against the last snapshot on an interval
+func (jobWatcher *JobWatcher) poll() {
+	defer close(jobWatcher.events)
+
+	began := time.Now()
+	since := began
+
+	// The first pass only records what already exists
+	var snapshot map[bson.ObjectId]polledJob
+
+	for {
+		// The next pass looks for jobs started from here on
+		started := time.Now()
+
+		current, open, err := jobWatcher.pollPass(began, since, snapshot)
+		if !open {
+			return
+		}
+
+		// Keep the last snapshot and window if the poll failed
+		if err != nil {
+			tracelog.Error(err, jobWatcher.goRoutine, "JobWatcher.poll")
+		} else {
+			snapshot = current
+			since = started
+		}
+
+		select {
+		case <-jobWatcher.shutdown:
+			return
+		case <-time.After(WATCH_POLL_INTERVAL):
+		}
+	}
+}
+
+// pollPass delivers events for the jobs that changed since the snapshot and returns the new
+// snapshot. A nil snapshot only records what exists. Returns false if the watcher was closed.
+func (jobWatcher *JobWatcher) pollPass(began time.Time, since time.Time, snapshot map[bson.ObjectId]polledJob) (current map[bson.ObjectId]polledJob, open bool, err error) {
+	defer helper.CatchPanic(&err, jobWatcher.goRoutine, "JobWatcher.pollPass")
+
+	mongoSession, err := mongo.CopySession(jobWatcher.goRoutine, jobWatcher.useSession)
+	if err != nil {
+		return current, true, err
+	}
+
+	defer mongo.CloseSession(jobWatcher.goRoutine, mongoSession)
+
+	collection, err := mongo.GetCollection(mongoSession, jobWatcher.useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		return current, true, err
+	}
+
+	states, err := jobWatcher.pollJobs(collection, since, snapshot)
+	if err != nil {
+		return current, true, err
+	}
+
+	// Jobs that drop out of the query are no longer tracked
+	current = make(map[bson.ObjectId]polledJob, len(states))
+
+	for _, state := range states {
+		previous, known := snapshot[state.ObjectId]
+		current[state.ObjectId] = state
+
+		if snapshot == nil {
+			continue
+		}
+
+		events, err := jobWatcher.pollEvents(collection, began, state, previous, known)
+		if err != nil {
+			// Report the change on the next pass
+			tracelog.Error(err, jobWatcher.goRoutine, "JobWatcher.pollPass")
+
+			if known {
+				current[state.ObjectId] = previous
+			} else {
+				delete(current, state.ObjectId)
+			}
+
+			continue
+		}
+
+		for _, event := range events {
+			select {
+			case jobWatcher.events <- event:
+			case <-jobWatcher.shutdown:
+				return current, false, nil
+			}
+		}
+	}
+
+	return current, true, nil
+}
+
+// pollEvents reads the job when it changed and returns its events. Jobs the watcher did not know
+// are inserts when they were created after the watch began.
+func (jobWatcher *JobWatcher) pollEvents(collection *mgo.Collection, began time.Time, state polledJob, previous polledJob, known bool) (events []JobEvent, err error) {
+	newDetails := 0
+	if known && state.Details > previous.Details {
+		newDetails = state.Details - previous.Details
+	}
+
+	if known && previous.Status == state.Status && newDetails == 0 {
+		return events, nil
+	}
+
+	// Only the details that are new are read
+	selector := bson.M{"details": 0}
+	if newDetails > 0 {
+		selector = bson.M{"details": bson.M{"$slice": []int{previous.Details, newDetails}}}
+	}
+
+	job := &Job{}
+	err = mongo.Measure(jobWatcher.goRoutine, collection, "PollJob", bson.M{"_id": state.ObjectId}, func() error {
+		return collection.FindId(state.ObjectId).Select(selector).One(job)
+	})
+	if err != nil {
+		return events, err
+	}
+
+	details := job.Details
+	job.Details = nil
+
+	switch {
+	case !known && !state.ObjectId.Time().Before(began.Truncate(time.Second)):
+		events = append(events, JobEvent{Type: JOB_EVENT_INSERT, JobId: state.ObjectId, Job: job})
+
+	// An older job the last pass did not return, such as one taken back to pending
+	case !known:
+		events = append(events, JobEvent{Type: JOB_EVENT_STATUS, JobId: state.ObjectId, Job: job, Status: state.Status})
+
+	case previous.Status != state.Status:
+		events = append(events, JobEvent{Type: JOB_EVENT_STATUS, JobId: state.ObjectId, Job: job, Status: state.Status})
+	}
+
+	if len(details) > 0 {
+		events = append(events, JobEvent{Type: JOB_EVENT_DETAIL, JobId: state.ObjectId, Job: job, Details: details})
+	}
+
+	return events, nil
+}
+
+// pollJobs returns the status and detail count of jobs started since the last pass, pending and
+// running jobs, and tracked jobs that were unfinished on the last pass so their final status is seen
+func (jobWatcher *JobWatcher) pollJobs(collection *mgo.Collection, since time.Time, snapshot map[bson.ObjectId]polledJob) (states []polledJob, err error) {
+	tracked := make([]bson.ObjectId, 0, len(snapshot))
+	for jobId, state := range snapshot {
+		if state.Status == JOB_STATUS_PENDING || state.Status == JOB_STATUS_RUNNING {
+			tracked = append(tracked, jobId)
+		}
+	}
+
+	query := bson.M{"$or": []bson.M{
+		{"start_date": bson.M{"$gte": since}},
+		{"status": bson.M{"$in": []string{JOB_STATUS_PENDING, JOB_STATUS_RUNNING}}},
+		{"_id": bson.M{"$in": tracked}},
+	}}
+
+	// Details are counted on the server rather than read
+	pipeline := []bson.M{
+		{"$match": query},
+		{"$project": bson.M{
+			"status":  1,
+			"details": bson.M{"$size": bson.M{"$ifNull": []interface{}{"$details", []interface{}{}}}},
+		}},
+	}
+
+	err = mongo.Measure(jobWatcher.goRoutine, collection, "PollJobs", query, func() error {
+		return collection.Pipe(pipeline).All(&states)
+	})
+	return states, err
+}
+
+// setErr records the error that stopped the watcher
+func (jobWatcher *JobWatcher) setErr(err error) {
+	jobWatcher.mutex.Lock()
+	jobWatcher.err = err
+	jobWatcher.mutex.Unlock()
+
+	tracelog.Error(err, jobWatcher.goRoutine, "JobWatcher")
+}
+
+//** PRIVATE FUNCTIONS
+
+// changeStreamsUnsupported returns true if the server cannot open a change stream
+func changeStreamsUnsupported(err error) bool {
+	queryError, ok := err.(*mgo.QueryError)
+	if !ok {
+		return false
+	}
+
+	switch queryError.Code {
+	case 40573: // Not a replica set
+		return true
+	case 40324: // Server older than 3.6
+		return true
+	}
+
+	message := strings.ToLower(queryError.Message)
+	return strings.Contains(message, "only supported on replica sets") || strings.Contains(message, "unrecognized pipeline stage name: '$changestream'")
+}
@@ -0,0 +1,74 @@
+package data
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+//** TESTS
+
+// TestDeliverDetails checks only the details past the ones already seen are delivered
+func TestDeliverDetails(t *testing.T) {
+	jobId := bson.NewObjectId()
+	first := JobDetail{Task: "first", Details: "one"}
+	second := JobDetail{Task: "second", Details: "two"}
+	third := JobDetail{Task: "third", Details: "three"}
+
+	tests := []struct {
+		name    string
+		updated bson.D
+		tasks   []string
+	}{
+		{"array created", bson.D{{Name: "details", Value: []JobDetail{first}}}, []string{"first"}},
+		{"entry appended", bson.D{{Name: "details.1", Value: second}}, []string{"second"}},
+		{"array replaced", bson.D{{Name: "details", Value: []JobDetail{first, second, third}}}, []string{"third"}},
+		{"array rewritten", bson.D{{Name: "details", Value: []JobDetail{first, second, third}}}, nil},
+		{"entry rewritten", bson.D{{Name: "details.0", Value: first}}, nil},
+		{"status", bson.D{{Name: "status", Value: JOB_STATUS_COMPLETED}}, nil},
+		{"after the job ended", bson.D{{Name: "details", Value: []JobDetail{first}}}, []string{"first"}},
+	}
+
+	jobWatcher := &JobWatcher{
+		events:       make(chan JobEvent, WATCH_EVENT_BUFFER),
+		shutdown:     make(chan struct{}),
+		detailCounts: map[bson.ObjectId]int{},
+	}
+
+	for _, test := range tests {
+		data, err := bson.Marshal(test.updated)
+		if err != nil {
+			t.Fatalf("%s : Unable to marshal the update : %s", test.name, err)
+		}
+
+		change := changeEvent{OperationType: "update", DocumentKey: bson.M{"_id": jobId}}
+		change.UpdateDescription.UpdatedFields = bson.Raw{Kind: 0x03, Data: data}
+
+		if !jobWatcher.deliver(change) {
+			t.Fatalf("%s : Expected the change to be delivered", test.name)
+		}
+
+		var tasks []string
+		for len(jobWatcher.events) > 0 {
+			event := <-jobWatcher.events
+			if event.Type != JOB_EVENT_DETAIL {
+				continue
+			}
+
+			for _, detail := range event.Details {
+				tasks = append(tasks, detail.Task)
+			}
+		}
+
+		if len(tasks) != len(test.tasks) {
+			t.Errorf("%s : Expected details %v, got %v", test.name, test.tasks, tasks)
+			continue
+		}
+
+		for index := range tasks {
+			if tasks[index] != test.tasks[index] {
+				t.Errorf("%s : Expected details %v, got %v", test.name, test.tasks, tasks)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,753 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/task/mongo"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	WORKFLOWS_COLLECTION = "data_workflows"
+
+	WORKFLOW_STATUS_RUNNING      = "running"
+	WORKFLOW_STATUS_COMPLETED    = "completed"
+	WORKFLOW_STATUS_FAILED       = "failed"
+	WORKFLOW_STATUS_COMPENSATING = "compensating"
+	WORKFLOW_STATUS_COMPENSATED  = "compensated"
+
+	STEP_STATUS_PENDING   = "pending"
+	STEP_STATUS_RUNNING   = "running"
+	STEP_STATUS_COMPLETED = "completed"
+	STEP_STATUS_FAILED    = "failed"
+	STEP_STATUS_SKIPPED   = "skipped"
+
+	FAILURE_POLICY_STOP       = "stop"       // Start no new steps once a step fails
+	FAILURE_POLICY_CONTINUE   = "continue"   // Keep running steps that do not depend on the failed step
+	FAILURE_POLICY_COMPENSATE = "compensate" // Stop, then undo completed steps in reverse dependency order
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// ErrWorkflowChanged is returned when another coordinator advanced the workflow first
+	ErrWorkflowChanged = errors.New("Workflow Changed By Another Coordinator")
+)
+
+//** TYPES
+
+type (
+	// WorkflowStep defines one step of a workflow. Each step runs as a job of JobType
+	// that the step's task process picks up with ClaimJob.
+	WorkflowStep struct {
+		Name       string   `bson:"name"`
+		JobType    string   `bson:"job_type"`
+		DependsOn  []string `bson:"depends_on,omitempty"`
+		Retries    int      `bson:"retries"`
+		Compensate string   `bson:"compensate,omitempty"` // Job type that undoes the step
+	}
+
+	// WorkflowStepState is a step and its progress
+	WorkflowStepState struct {
+		WorkflowStep       `bson:",inline"`
+		Status             string        `bson:"status"`
+		Attempts           int           `bson:"attempts"`
+		JobId              bson.ObjectId `bson:"job_id,omitempty"`
+		Result             string        `bson:"result,omitempty"`
+		CompensationJobId  bson.ObjectId `bson:"compensation_job_id,omitempty"`
+		CompensationStatus string        `bson:"compensation_status,omitempty"`
+	}
+
+	// Workflow contains a workflow definition and its progress
+	Workflow struct {
+		ObjectId      bson.ObjectId       `bson:"_id"`
+		Name          string              `bson:"name"`
+		FailurePolicy string              `bson:"failure_policy"`
+		Labels        Labels              `bson:"labels,omitempty"`
+		Status        string              `bson:"status"`
+		StartDate     time.Time           `bson:"start_date"`
+		EndDate       time.Time           `bson:"end_date,omitempty"`
+		Revision      int                 `bson:"revision"`
+		Steps         []WorkflowStepState `bson:"steps"`
+	}
+
+	// JobWorkflow links a job to the workflow step it runs
+	JobWorkflow struct {
+		WorkflowId   bson.ObjectId `bson:"workflow_id"`
+		Step         string        `bson:"step"`
+		Attempt      int           `bson:"attempt"`
+		Compensation bool          `bson:"compensation,omitempty"`
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// CreateWorkflow validates the steps and inserts a new running workflow. Call AdvanceWorkflow
+// or CoordinateWorkflow to create the jobs for the first steps.
+func CreateWorkflow(goRoutine string, useSession string, useDatabase string, name string, failurePolicy string, labels Labels, steps []WorkflowStep) (workflow *Workflow, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "CreateWorkflow")
+
+	tracelog.Startedf(goRoutine, "CreateWorkflow", "UseSession[%s] UseDatabase[%s] Name[%s] FailurePolicy[%s] Steps[%d]", useSession, useDatabase, name, failurePolicy, len(steps))
+
+	if err = validateWorkflow(failurePolicy, steps); err != nil {
+		tracelog.CompletedError(err, goRoutine, "CreateWorkflow")
+		return workflow, err
+	}
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "CreateWorkflow")
+		return workflow, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the workflows collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, WORKFLOWS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "CreateWorkflow")
+		return workflow, err
+	}
+
+	workflow = &Workflow{
+		ObjectId:      bson.NewObjectId(),
+		Name:          name,
+		FailurePolicy: failurePolicy,
+		Labels:        labels,
+		Status:        WORKFLOW_STATUS_RUNNING,
+		StartDate:     time.Now(),
+		Steps:         make([]WorkflowStepState, 0, len(steps)),
+	}
+
+	for _, step := range steps {
+		workflow.Steps = append(workflow.Steps, WorkflowStepState{WorkflowStep: step, Status: STEP_STATUS_PENDING})
+	}
+
+	err = mongo.Measure(goRoutine, collection, "CreateWorkflow", nil, func() error {
+		return collection.Insert(workflow)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "CreateWorkflow")
+		return workflow, err
+	}
+
+	tracelog.Completedf(goRoutine, "CreateWorkflow", "Id[%v]", workflow.ObjectId)
+	return workflow, err
+}
+
+// GetWorkflow returns the specified workflow
+func GetWorkflow(goRoutine string, useSession string, useDatabase string, workflowId bson.ObjectId) (workflow *Workflow, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "GetWorkflow")
+
+	tracelog.Startedf(goRoutine, "GetWorkflow", "UseSession[%s] UseDatabase[%s] Id[%v]", useSession, useDatabase, workflowId)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "GetWorkflow")
+		return workflow, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the workflows collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, WORKFLOWS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "GetWorkflow")
+		return workflow, err
+	}
+
+	workflow = &Workflow{}
+	err = mongo.Measure(goRoutine, collection, "GetWorkflow", bson.M{"_id": workflowId}, func() error {
+		return collection.FindId(workflowId).One(workflow)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "GetWorkflow")
+		return nil, err
+	}
+
+	tracelog.Completed(goRoutine, "GetWorkflow")
+	return workflow, err
+}
+
+// FindWorkflows returns the workflows with the specified name and status, newest first.
+// Empty values match every workflow.
+func FindWorkflows(goRoutine string, useSession string, useDatabase string, name string, status string) (workflows []Workflow, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "FindWorkflows")
+
+	tracelog.Startedf(goRoutine, "FindWorkflows", "UseSession[%s] UseDatabase[%s] Name[%s] Status[%s]", useSession, useDatabase, name, status)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "FindWorkflows")
+		return workflows, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the workflows collection
+	collection, err := mongo.GetCollection(mongoSession, useDatabase, WORKFLOWS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "FindWorkflows")
+		return workflows, err
+	}
+
+	query := bson.M{}
+	if name != "" {
+		query["name"] = name
+	}
+
+	if status != "" {
+		query["status"] = status
+	}
+
+	err = mongo.Measure(goRoutine, collection, "FindWorkflows", query, func() error {
+		return collection.Find(query).Sort("-start_date").All(&workflows)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "FindWorkflows")
+		return workflows, err
+	}
+
+	tracelog.Completedf(goRoutine, "FindWorkflows", "Count[%d]", len(workflows))
+	return workflows, err
+}
+
+// AdvanceWorkflow checks the jobs of running steps, applies retries and the failure policy,
+// and creates jobs for steps whose dependencies have completed. ErrWorkflowChanged is
+// returned if another coordinator saved the workflow first.
+func AdvanceWorkflow(goRoutine string, useSession string, useDatabase string, workflowId bson.ObjectId) (workflow *Workflow, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "AdvanceWorkflow")
+
+	tracelog.Startedf(goRoutine, "AdvanceWorkflow", "UseSession[%s] UseDatabase[%s] Id[%v]", useSession, useDatabase, workflowId)
+
+	// Grab a mongo session
+	mongoSession, err := mongo.CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "AdvanceWorkflow")
+		return workflow, err
+	}
+
+	defer mongo.CloseSession(goRoutine, mongoSession)
+
+	// Access the collections
+	workflows, err := mongo.GetCollection(mongoSession, useDatabase, WORKFLOWS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "AdvanceWorkflow")
+		return workflow, err
+	}
+
+	jobs, err := mongo.GetCollection(mongoSession, useDatabase, JOBS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "AdvanceWorkflow")
+		return workflow, err
+	}
+
+	// Step jobs rely on the unique idempotency index to never be created twice
+	if err = ensureIdempotencyIndex(goRoutine, useSession, jobs); err != nil {
+		tracelog.CompletedError(err, goRoutine, "AdvanceWorkflow")
+		return workflow, err
+	}
+
+	workflow = &Workflow{}
+	err = mongo.Measure(goRoutine, workflows, "GetWorkflow", bson.M{"_id": workflowId}, func() error {
+		return workflows.FindId(workflowId).One(workflow)
+	})
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "AdvanceWorkflow")
+		return nil, err
+	}
+
+	if workflow.finished() {
+		tracelog.Completedf(goRoutine, "AdvanceWorkflow", "Finished Status[%s]", workflow.Status)
+		return workflow, err
+	}
+
+	revision := workflow.Revision
+
+	if err = workflow.advance(goRoutine, jobs); err != nil {
+		tracelog.CompletedError(err, goRoutine, "AdvanceWorkflow")
+		return workflow, err
+	}
+
+	// Save only if nobody else advanced the workflow since we read it. Jobs created
+	// above use idempotency keys so a losing coordinator does not duplicate them.
+	workflow.Revision = revision + 1
+
+	query := bson.M{"_id": workflow.ObjectId, "revision": revision}
+	err = mongo.Measure(goRoutine, workflows, "AdvanceWorkflow", query, func() error {
+		return workflows.Update(query, workflow)
+	})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			err = ErrWorkflowChanged
+		}
+
+		tracelog.CompletedError(err, goRoutine, "AdvanceWorkflow")
+		return workflow, err
+	}
+
+	tracelog.Completedf(goRoutine, "AdvanceWorkflow", "Status[%s]", workflow.Status)
+	return workflow, err
+}
+
+// CoordinateWorkflow advances the workflow on the interval until it finishes or isShutdown returns true.
+// Pass controller.IsShutdown so the coordinator stops with the program.
+func CoordinateWorkflow(goRoutine string, useSession string, useDatabase string, workflowId bson.ObjectId, interval time.Duration, isShutdown func() bool) (workflow *Workflow, err error) {
+	tracelog.Startedf(goRoutine, "CoordinateWorkflow", "Id[%v] Interval[%v]", workflowId, interval)
+
+	for {
+		workflow, err = AdvanceWorkflow(goRoutine, useSession, useDatabase, workflowId)
+
+		switch {
+		case err == ErrWorkflowChanged:
+			// Pick up the other coordinator's changes on the next pass
+
+		case err != nil:
+			tracelog.CompletedError(err, goRoutine, "CoordinateWorkflow")
+			return workflow, err
+
+		case workflow.finished():
+			tracelog.Completedf(goRoutine, "CoordinateWorkflow", "Status[%s]", workflow.Status)
+			return workflow, nil
+		}
+
+		if isShutdown != nil && isShutdown() {
+			tracelog.Completedf(goRoutine, "CoordinateWorkflow", "Shutdown Requested")
+			return workflow, nil
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+//** MEMBER FUNCTIONS
+
+// Step returns the state of the named step
+func (workflow *Workflow) Step(name string) *WorkflowStepState {
+	for index := range workflow.Steps {
+		if workflow.Steps[index].Name == name {
+			return &workflow.Steps[index]
+		}
+	}
+
+	return nil
+}
+
+// finished returns true when the workflow will not change again
+func (workflow *Workflow) finished() bool {
+	switch workflow.Status {
+	case WORKFLOW_STATUS_COMPLETED, WORKFLOW_STATUS_FAILED, WORKFLOW_STATUS_COMPENSATED:
+		return true
+	}
+
+	return false
+}
+
+// advance moves the workflow forward based on the state of its jobs
+func (workflow *Workflow) advance(goRoutine string, jobs *mgo.Collection) (err error) {
+	// Pick up the results of running steps
+	for index := range workflow.Steps {
+		step := &workflow.Steps[index]
+
+		if step.Status == STEP_STATUS_RUNNING {
+			if err = workflow.checkStep(goRoutine, jobs, step); err != nil {
+				return err
+			}
+		}
+
+		if step.CompensationStatus == JOB_STATUS_PENDING || step.CompensationStatus == JOB_STATUS_RUNNING {
+			var job Job
+			err = mongo.Measure(goRoutine, jobs, "CheckWorkflowStep", bson.M{"_id": step.CompensationJobId}, func() error {
+				return jobs.FindId(step.CompensationJobId).One(&job)
+			})
+
+			switch {
+			// The job was removed by CleanJobs so its outcome is unknown
+			case err == mgo.ErrNotFound:
+				tracelog.Warning(goRoutine, "Workflow.advance", "Compensation Job Not Found : Workflow[%v] Step[%s] Job[%v]", workflow.ObjectId, step.Name, step.CompensationJobId)
+				step.CompensationStatus = JOB_STATUS_FAILED
+				err = nil
+
+			case err != nil:
+				return err
+
+			default:
+				step.CompensationStatus = job.Status
+			}
+		}
+	}
+
+	failed := workflow.countSteps(STEP_STATUS_FAILED) > 0
+
+	// Apply the failure policy to the steps that have not started
+	if failed {
+		for index := range workflow.Steps {
+			step := &workflow.Steps[index]
+
+			if step.Status != STEP_STATUS_PENDING {
+				continue
+			}
+
+			if workflow.FailurePolicy != FAILURE_POLICY_CONTINUE || workflow.blocked(step) {
+				tracelog.Trace(goRoutine, "Workflow.advance", "Info : Skipping Step : Workflow[%v] Step[%s]", workflow.ObjectId, step.Name)
+				step.Status = STEP_STATUS_SKIPPED
+			}
+		}
+
+		// Skipping a step can block the steps that depend on it
+		for workflow.FailurePolicy == FAILURE_POLICY_CONTINUE {
+			skipped := false
+
+			for index := range workflow.Steps {
+				step := &workflow.Steps[index]
+				if step.Status == STEP_STATUS_PENDING && workflow.blocked(step) {
+					step.Status = STEP_STATUS_SKIPPED
+					skipped = true
+				}
+			}
+
+			if !skipped {
+				break
+			}
+		}
+	}
+
+	// Start the steps whose dependencies have completed
+	for index := range workflow.Steps {
+		step := &workflow.Steps[index]
+
+		if step.Status == STEP_STATUS_PENDING && workflow.ready(step) {
+			if err = workflow.startStep(goRoutine, jobs, step); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Wait for the running steps to settle
+	if workflow.countSteps(STEP_STATUS_PENDING) > 0 || workflow.countSteps(STEP_STATUS_RUNNING) > 0 {
+		return err
+	}
+
+	switch {
+	case !failed:
+		workflow.finish(WORKFLOW_STATUS_COMPLETED)
+
+	case workflow.FailurePolicy == FAILURE_POLICY_COMPENSATE:
+		workflow.Status = WORKFLOW_STATUS_COMPENSATING
+		return workflow.compensate(goRoutine, jobs)
+
+	default:
+		workflow.finish(WORKFLOW_STATUS_FAILED)
+	}
+
+	return err
+}
+
+// checkStep reads the job of a running step and retries it if it failed. A step whose job
+// was removed, such as by CleanJobs, fails since its outcome is unknown.
+func (workflow *Workflow) checkStep(goRoutine string, jobs *mgo.Collection, step *WorkflowStepState) (err error) {
+	var job Job
+	err = mongo.Measure(goRoutine, jobs, "CheckWorkflowStep", bson.M{"_id": step.JobId}, func() error {
+		return jobs.FindId(step.JobId).One(&job)
+	})
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			return err
+		}
+
+		tracelog.Warning(goRoutine, "Workflow.checkStep", "Step Job Not Found : Workflow[%v] Step[%s] Job[%v]", workflow.ObjectId, step.Name, step.JobId)
+		step.Status = STEP_STATUS_FAILED
+		step.Result = fmt.Sprintf("Step Job %s Not Found, It Was Removed Before The Workflow Saw It Finish", step.JobId.Hex())
+		return nil
+	}
+
+	switch job.Status {
+	case JOB_STATUS_COMPLETED:
+		step.Status = STEP_STATUS_COMPLETED
+		step.Result = job.Result
+
+	case JOB_STATUS_FAILED:
+		step.Result = job.Result
+
+		if step.Attempts <= step.Retries {
+			tracelog.Trace(goRoutine, "Workflow.checkStep", "Info : Retrying Step : Workflow[%v] Step[%s] Attempt[%d]", workflow.ObjectId, step.Name, step.Attempts+1)
+			return workflow.startStep(goRoutine, jobs, step)
+		}
+
+		tracelog.Warning(goRoutine, "Workflow.checkStep", "Step Failed : Workflow[%v] Step[%s] Result[%s]", workflow.ObjectId, step.Name, job.Result)
+		step.Status = STEP_STATUS_FAILED
+	}
+
+	return err
+}
+
+// startStep creates the pending job for the next attempt of the step
+func (workflow *Workflow) startStep(goRoutine string, jobs *mgo.Collection, step *WorkflowStepState) (err error) {
+	attempt := step.Attempts + 1
+
+	job, err := workflow.createJob(goRoutine, jobs, step.JobType, &JobWorkflow{
+		WorkflowId: workflow.ObjectId,
+		Step:       step.Name,
+		Attempt:    attempt,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	tracelog.Trace(goRoutine, "Workflow.startStep", "Info : Step Job Created : Workflow[%v] Step[%s] Attempt[%d] Job[%v]", workflow.ObjectId, step.Name, attempt, job.ObjectId)
+
+	step.Status = STEP_STATUS_RUNNING
+	step.Attempts = attempt
+	step.JobId = job.ObjectId
+	return err
+}
+
+// compensate creates compensation jobs for completed steps once every step depending
+// on them has been compensated, and finishes the workflow when compensation settles
+func (workflow *Workflow) compensate(goRoutine string, jobs *mgo.Collection) (err error) {
+	outstanding := 0
+
+	for index := range workflow.Steps {
+		step := &workflow.Steps[index]
+
+		if !step.needsCompensation() {
+			continue
+		}
+
+		if step.CompensationStatus != "" {
+			if step.CompensationStatus == JOB_STATUS_PENDING || step.CompensationStatus == JOB_STATUS_RUNNING {
+				outstanding++
+			}
+			continue
+		}
+
+		// A failed compensation leaves the steps it depends on alone
+		switch workflow.dependentsCompensation(step) {
+		case JOB_STATUS_FAILED:
+			continue
+		case JOB_STATUS_PENDING:
+			outstanding++
+			continue
+		}
+
+		outstanding++
+
+		job, err := workflow.createJob(goRoutine, jobs, step.Compensate, &JobWorkflow{
+			WorkflowId:   workflow.ObjectId,
+			Step:         step.Name,
+			Attempt:      1,
+			Compensation: true,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		tracelog.Trace(goRoutine, "Workflow.compensate", "Info : Compensation Job Created : Workflow[%v] Step[%s] Job[%v]", workflow.ObjectId, step.Name, job.ObjectId)
+
+		step.CompensationJobId = job.ObjectId
+		step.CompensationStatus = JOB_STATUS_PENDING
+	}
+
+	if outstanding > 0 {
+		return err
+	}
+
+	for _, step := range workflow.Steps {
+		if step.needsCompensation() && step.CompensationStatus != JOB_STATUS_COMPLETED {
+			workflow.finish(WORKFLOW_STATUS_FAILED)
+			return err
+		}
+	}
+
+	workflow.finish(WORKFLOW_STATUS_COMPENSATED)
+	return err
+}
+
+// createJob inserts a pending job for the step. The idempotency key makes the insert
+// safe to repeat if another coordinator already created the job.
+func (workflow *Workflow) createJob(goRoutine string, jobs *mgo.Collection, jobType string, jobWorkflow *JobWorkflow) (job *Job, err error) {
+	idempotencyKey := fmt.Sprintf("workflow:%s:%s:%d", workflow.ObjectId.Hex(), jobWorkflow.Step, jobWorkflow.Attempt)
+	if jobWorkflow.Compensation {
+		idempotencyKey += ":compensate"
+	}
+
+	labels := workflow.Labels.Merge(Labels{"workflow": workflow.Name, "step": jobWorkflow.Step})
+
+	job = &Job{
+		ObjectId:       bson.NewObjectId(),
+		SchemaVersion:  JOB_SCHEMA_VERSION,
+		Type:           jobType,
+		IdempotencyKey: idempotencyKey,
+		Labels:         labels,
+		LabelIndex:     labels.index(),
+		Status:         JOB_STATUS_PENDING,
+		StartDate:      time.Now(),
+		QueueDate:      time.Now(),
+		Workflow:       jobWorkflow,
+	}
+
+	err = mongo.Measure(goRoutine, jobs, "StartWorkflowJob", nil, func() error {
+		return jobs.Insert(job)
+	})
+	if err != nil {
+		if mgo.IsDup(err) {
+			return findJobByKey(jobs, idempotencyKey)
+		}
+
+		return nil, err
+	}
+
+	return job, err
+}
+
+// finish sets the final status of the workflow
+func (workflow *Workflow) finish(status string) {
+	workflow.Status = status
+	workflow.EndDate = time.Now()
+}
+
+// countSteps returns the number of steps with the specified status
+func (workflow *Workflow) countSteps(status string) (count int) {
+	for _, step := range workflow.Steps {
+		if step.Status == status {
+			count++
+		}
+	}
+
+	return count
+}
+
+// ready returns true when every dependency of the step has completed
+func (workflow *Workflow) ready(step *WorkflowStepState) bool {
+	for _, name := range step.DependsOn {
+		if workflow.Step(name).Status != STEP_STATUS_COMPLETED {
+			return false
+		}
+	}
+
+	return true
+}
+
+// blocked returns true when a dependency of the step failed or was skipped
+func (workflow *Workflow) blocked(step *WorkflowStepState) bool {
+	for _, name := range step.DependsOn {
+		switch workflow.Step(name).Status {
+		case STEP_STATUS_FAILED, STEP_STATUS_SKIPPED:
+			return true
+		}
+	}
+
+	return false
+}
+
+// dependentsCompensation summarizes the compensation of the completed steps that depend on the
+// specified step: failed if any failed, pending if any are outstanding, otherwise completed
+func (workflow *Workflow) dependentsCompensation(step *WorkflowStepState) string {
+	status := JOB_STATUS_COMPLETED
+
+	for _, other := range workflow.Steps {
+		if !other.needsCompensation() {
+			continue
+		}
+
+		for _, name := range other.DependsOn {
+			if name != step.Name {
+				continue
+			}
+
+			switch other.CompensationStatus {
+			case JOB_STATUS_COMPLETED:
+			case JOB_STATUS_FAILED:
+				return JOB_STATUS_FAILED
+			default:
+				status = JOB_STATUS_PENDING
+			}
+		}
+	}
+
+	return status
+}
+
+// needsCompensation returns true when the step completed and has a compensation job type
+func (step *WorkflowStepState) needsCompensation() bool {
+	return step.Status == STEP_STATUS_COMPLETED && step.Compensate != ""
+}
+
+//** PRIVATE FUNCTIONS
+
+// validateWorkflow checks the failure policy, step names, dependencies and that the steps form a DAG
+func validateWorkflow(failurePolicy string, steps []WorkflowStep) error {
+	switch failurePolicy {
+	case FAILURE_POLICY_STOP, FAILURE_POLICY_CONTINUE, FAILURE_POLICY_COMPENSATE:
+	default:
+		return fmt.Errorf("Unknown Failure Policy %s", failurePolicy)
+	}
+
+	if len(steps) == 0 {
+		return errors.New("Workflow Has No Steps")
+	}
+
+	dependents := map[string][]string{}
+	remaining := map[string]int{}
+
+	for _, step := range steps {
+		if step.Name == "" || step.JobType == "" {
+			return errors.New("Workflow Step Requires A Name And Job Type")
+		}
+
+		if _, exists := remaining[step.Name]; exists {
+			return fmt.Errorf("Duplicate Workflow Step %s", step.Name)
+		}
+
+		remaining[step.Name] = len(step.DependsOn)
+	}
+
+	for _, step := range steps {
+		for _, name := range step.DependsOn {
+			if _, exists := remaining[name]; !exists {
+				return fmt.Errorf("Workflow Step %s Depends On Unknown Step %s", step.Name, name)
+			}
+
+			dependents[name] = append(dependents[name], step.Name)
+		}
+	}
+
+	// Remove steps with no outstanding dependencies until none are left
+	var ready []string
+	for name, count := range remaining {
+		if count == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	visited := 0
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		visited++
+
+		for _, dependent := range dependents[name] {
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if visited != len(steps) {
+		return errors.New("Workflow Steps Contain A Dependency Cycle")
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+//** TESTS
+
+// TestValidateWorkflow checks the failure policy, step names, dependencies and cycles
+func TestValidateWorkflow(t *testing.T) {
+	load := WorkflowStep{Name: "load", JobType: "load"}
+	transform := WorkflowStep{Name: "transform", JobType: "transform", DependsOn: []string{"load"}}
+	report := WorkflowStep{Name: "report", JobType: "report", DependsOn: []string{"load", "transform"}}
+
+	tests := []struct {
+		name          string
+		failurePolicy string
+		steps         []WorkflowStep
+		message       string // Expected error text, none when empty
+	}{
+		{"single step", FAILURE_POLICY_STOP, []WorkflowStep{load}, ""},
+		{"diamond", FAILURE_POLICY_COMPENSATE, []WorkflowStep{report, transform, load}, ""},
+		{"unknown policy", "retry", []WorkflowStep{load}, "Unknown Failure Policy retry"},
+		{"no steps", FAILURE_POLICY_CONTINUE, nil, "Workflow Has No Steps"},
+		{"no name", FAILURE_POLICY_STOP, []WorkflowStep{{JobType: "load"}}, "Requires A Name And Job Type"},
+		{"no job type", FAILURE_POLICY_STOP, []WorkflowStep{{Name: "load"}}, "Requires A Name And Job Type"},
+		{"duplicate", FAILURE_POLICY_STOP, []WorkflowStep{load, load}, "Duplicate Workflow Step load"},
+		{"unknown dependency", FAILURE_POLICY_STOP, []WorkflowStep{transform}, "transform Depends On Unknown Step load"},
+		{"self cycle", FAILURE_POLICY_STOP, []WorkflowStep{{Name: "load", JobType: "load", DependsOn: []string{"load"}}}, "Dependency Cycle"},
+		{"cycle", FAILURE_POLICY_STOP, []WorkflowStep{
+			{Name: "load", JobType: "load", DependsOn: []string{"report"}},
+			transform,
+			report,
+		}, "Dependency Cycle"},
+	}
+
+	for _, test := range tests {
+		err := validateWorkflow(test.failurePolicy, test.steps)
+
+		if test.message == "" {
+			if err != nil {
+				t.Errorf("%s : Expected no error, got %s", test.name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s : Expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+}
+
+// TestWorkflowReadyBlocked checks a step is ready once its dependencies complete and blocked
+// once one fails or is skipped
+func TestWorkflowReadyBlocked(t *testing.T) {
+	tests := []struct {
+		load      string
+		transform string
+		ready     bool
+		blocked   bool
+	}{
+		{STEP_STATUS_PENDING, STEP_STATUS_PENDING, false, false},
+		{STEP_STATUS_COMPLETED, STEP_STATUS_RUNNING, false, false},
+		{STEP_STATUS_COMPLETED, STEP_STATUS_COMPLETED, true, false},
+		{STEP_STATUS_COMPLETED, STEP_STATUS_FAILED, false, true},
+		{STEP_STATUS_SKIPPED, STEP_STATUS_COMPLETED, false, true},
+	}
+
+	for _, test := range tests {
+		workflow := &Workflow{Steps: []WorkflowStepState{
+			{WorkflowStep: WorkflowStep{Name: "load"}, Status: test.load},
+			{WorkflowStep: WorkflowStep{Name: "transform"}, Status: test.transform},
+			{WorkflowStep: WorkflowStep{Name: "report", DependsOn: []string{"load", "transform"}}, Status: STEP_STATUS_PENDING},
+		}}
+
+		step := workflow.Step("report")
+
+		if ready := workflow.ready(step); ready != test.ready {
+			t.Errorf("load %s transform %s : Expected ready %v, got %v", test.load, test.transform, test.ready, ready)
+		}
+
+		if blocked := workflow.blocked(step); blocked != test.blocked {
+			t.Errorf("load %s transform %s : Expected blocked %v, got %v", test.load, test.transform, test.blocked, blocked)
+		}
+	}
+}
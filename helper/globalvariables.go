@@ -10,4 +10,5 @@ var (
 	EmailTo           string // Address to send messages
 	EmailAlertSubject string // The subject for email alerts
 	TimeoutSeconds    int    // The timeout in seconds for kill the process
+	Environment       string // The straps environment the program is running in
 )
@@ -0,0 +1,258 @@
+// Copyright 2013 Ardan Studios. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"fmt"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/tracelog"
+	"sync"
+	"time"
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	monitor      *healthMonitor // The running health monitor or nil
+	monitorMutex sync.Mutex     // Protects monitor
+)
+
+//** TYPES
+
+type (
+	// Health is the result of the health checks for a session
+	Health struct {
+		Healthy     bool
+		LastCheck   time.Time
+		LastHealthy time.Time
+		Failures    int    // Failed checks since the session was last healthy
+		LastError   string // Error from the last failed check
+		Redials     int    // Times the session was dialed again after failing
+	}
+
+	// UnhealthyError is returned by CopySession and CloneSession while the health monitor
+	// cannot reach the servers for the session
+	UnhealthyError struct {
+		SessionName string
+		Since       time.Time
+		Cause       string
+	}
+
+	// healthMonitor pings the sessions on an interval
+	healthMonitor struct {
+		shutdown chan struct{}
+		done     chan struct{}
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// StartHealthMonitor pings every session on the interval. A session that fails is refreshed,
+// and dialed again if that does not help. While it stays unreachable CopySession and CloneSession
+// return an UnhealthyError. A monitor that is already running is replaced.
+func StartHealthMonitor(goRoutine string, interval time.Duration) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "StartHealthMonitor")
+
+	tracelog.Startedf(goRoutine, "StartHealthMonitor", "Interval[%v]", interval)
+
+	if interval <= 0 {
+		err = fmt.Errorf("Invalid Health Interval %v", interval)
+		tracelog.CompletedError(err, goRoutine, "StartHealthMonitor")
+		return err
+	}
+
+	StopHealthMonitor(goRoutine)
+
+	healthMonitor := &healthMonitor{
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	monitorMutex.Lock()
+	monitor = healthMonitor
+	monitorMutex.Unlock()
+
+	go healthMonitor.run(goRoutine, interval)
+
+	tracelog.Completed(goRoutine, "StartHealthMonitor")
+	return err
+}
+
+// StopHealthMonitor stops the health monitor if it is running
+func StopHealthMonitor(goRoutine string) {
+	monitorMutex.Lock()
+	healthMonitor := monitor
+	monitor = nil
+	monitorMutex.Unlock()
+
+	if healthMonitor == nil {
+		return
+	}
+
+	close(healthMonitor.shutdown)
+	<-healthMonitor.done
+
+	tracelog.Trace(goRoutine, "StopHealthMonitor", "Info : Health Monitor Stopped")
+}
+
+// CheckHealth checks every session once
+func CheckHealth(goRoutine string) {
+	for _, sessionName := range ListSessions() {
+		if session := singleton.get(sessionName); session != nil {
+			session.check(goRoutine, sessionName)
+		}
+	}
+}
+
+// SessionHealth returns the health of the named session
+func SessionHealth(sessionName string) (health Health, err error) {
+	session := singleton.get(sessionName)
+	if session == nil {
+		return health, fmt.Errorf("Unable To Locate Session %s", sessionName)
+	}
+
+	session.healthMutex.RLock()
+	defer session.healthMutex.RUnlock()
+
+	return session.health, err
+}
+
+// HealthStatus returns the health of every session by name
+func HealthStatus() map[string]Health {
+	status := map[string]Health{}
+
+	for _, sessionName := range ListSessions() {
+		if health, err := SessionHealth(sessionName); err == nil {
+			status[sessionName] = health
+		}
+	}
+
+	return status
+}
+
+// IsUnhealthy returns true if the error is an UnhealthyError
+func IsUnhealthy(err error) bool {
+	_, ok := err.(*UnhealthyError)
+	return ok
+}
+
+//** MEMBER FUNCTIONS
+
+// Error describes the unhealthy session
+func (unhealthyError *UnhealthyError) Error() string {
+	return fmt.Sprintf("Session %s Unhealthy Since %s : %s", unhealthyError.SessionName, unhealthyError.Since.Format(time.RFC3339), unhealthyError.Cause)
+}
+
+// run checks the sessions until the monitor is stopped
+func (healthMonitor *healthMonitor) run(goRoutine string, interval time.Duration) {
+	defer close(healthMonitor.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			CheckHealth(goRoutine)
+
+		case <-healthMonitor.shutdown:
+			return
+		}
+	}
+}
+
+// healthy returns an UnhealthyError if the last check failed
+func (session *mongoSession) healthy(sessionName string) error {
+	session.healthMutex.RLock()
+	defer session.healthMutex.RUnlock()
+
+	if session.health.Healthy {
+		return nil
+	}
+
+	return &UnhealthyError{
+		SessionName: sessionName,
+		Since:       session.health.LastHealthy,
+		Cause:       session.health.LastError,
+	}
+}
+
+// ping checks the servers can be reached using a copy of the session
+func (session *mongoSession) ping() error {
+	mongoSession := session.mongoSession.Copy()
+	defer mongoSession.Close()
+
+	return mongoSession.Ping()
+}
+
+// check pings the session, refreshing it and then dialing again when the ping fails
+func (session *mongoSession) check(goRoutine string, sessionName string) {
+	defer helper.CatchPanic(nil, goRoutine, "check")
+
+	err := session.ping()
+
+	if err != nil {
+		tracelog.Warning(goRoutine, "check", "Ping Failed, Refreshing : SessionName[%s] Error[%s]", sessionName, err)
+
+		session.mongoSession.Refresh()
+		err = session.ping()
+	}
+
+	if err != nil {
+		tracelog.Warning(goRoutine, "check", "Ping Failed, Dialing : SessionName[%s] Error[%s]", sessionName, err)
+
+		redialed, dialErr := dialSession(session.config)
+		if dialErr == nil {
+			session.healthMutex.RLock()
+			redialed.health.Redials = session.health.Redials + 1
+			session.healthMutex.RUnlock()
+
+			redialed.health.LastCheck = time.Now()
+			redialed.health.LastHealthy = redialed.health.LastCheck
+
+			// Someone may have replaced the session while we were dialing
+			if !singleton.swap(sessionName, session, redialed) {
+				redialed.mongoSession.Close()
+				return
+			}
+
+			tracelog.Trace(goRoutine, "check", "Info : Session Dialed Again : SessionName[%s]", sessionName)
+			CloseSession(goRoutine, session.mongoSession)
+			return
+		}
+
+		err = dialErr
+	}
+
+	session.record(goRoutine, sessionName, err)
+}
+
+// record saves the result of a check
+func (session *mongoSession) record(goRoutine string, sessionName string, err error) {
+	session.healthMutex.Lock()
+	defer session.healthMutex.Unlock()
+
+	now := time.Now()
+	session.health.LastCheck = now
+
+	if err == nil {
+		if !session.health.Healthy {
+			tracelog.Trace(goRoutine, "check", "Info : Session Healthy Again : SessionName[%s]", sessionName)
+		}
+
+		session.health.Healthy = true
+		session.health.LastHealthy = now
+		session.health.Failures = 0
+		return
+	}
+
+	if session.health.Healthy {
+		tracelog.Alert(helper.EmailAlertSubject, goRoutine, "check", "Mongo Session %s Unhealthy : %s", sessionName, err)
+	}
+
+	session.health.Healthy = false
+	session.health.Failures++
+	session.health.LastError = err.Error()
+}
@@ -0,0 +1,230 @@
+// Copyright 2013 Ardan Studios. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"fmt"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//** CONSTANTS
+
+const (
+	// TEXT_INDEX_KEY identifies the text index of a collection
+	TEXT_INDEX_KEY = "_fts_text_ftsx_1"
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	indexes      = map[indexTarget][]mgo.Index{} // Registered indexes by collection
+	indexesMutex sync.Mutex                      // Protects indexes
+)
+
+//** TYPES
+
+type (
+	// IndexReport describes what EnsureIndexes found and did. Entries are database.collection.index.
+	IndexReport struct {
+		Created []string
+		Changed []string // Registered indexes that exist with different options, these are not changed
+		Extra   []string // Indexes that exist but are not registered
+		Dropped []string
+	}
+
+	// indexTarget identifies a collection in a session
+	indexTarget struct {
+		session    string
+		database   string // The session's configured database when empty
+		collection string
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// RegisterIndexes declares the indexes a collection needs. Packages call it from init so the
+// indexes are created by EnsureIndexes at Startup. An empty session means the master session and
+// an empty database means the session's configured database. Use ExpireAfter for TTL indexes.
+func RegisterIndexes(useSession string, useDatabase string, collectionName string, collectionIndexes ...mgo.Index) {
+	if useSession == "" {
+		useSession = MASTER_SESSION
+	}
+
+	target := indexTarget{session: useSession, database: useDatabase, collection: collectionName}
+
+	indexesMutex.Lock()
+	defer indexesMutex.Unlock()
+
+	for _, index := range collectionIndexes {
+		index.Background = true
+		indexes[target] = append(indexes[target], index)
+	}
+}
+
+// EnsureIndexes creates the registered indexes that are missing and reports indexes that are not
+// registered, dropping them when dropExtra is true. Indexes registered without a database go in
+// useDatabase, or the session's configured database when it is empty. Collections of sessions
+// that do not exist are skipped.
+func EnsureIndexes(goRoutine string, useDatabase string, dropExtra bool) (indexReport *IndexReport, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "EnsureIndexes")
+
+	tracelog.Startedf(goRoutine, "EnsureIndexes", "UseDatabase[%s] DropExtra[%v]", useDatabase, dropExtra)
+
+	indexReport = &IndexReport{}
+
+	indexesMutex.Lock()
+	targets := make(map[indexTarget][]mgo.Index, len(indexes))
+	for target, collectionIndexes := range indexes {
+		targets[target] = collectionIndexes
+	}
+	indexesMutex.Unlock()
+
+	for target, collectionIndexes := range targets {
+		session := singleton.get(target.session)
+		if session == nil {
+			tracelog.Warning(goRoutine, "EnsureIndexes", "Session Not Found, Skipping : Session[%s] Collection[%s]", target.session, target.collection)
+			continue
+		}
+
+		targetDatabase := target.database
+		if targetDatabase == "" {
+			targetDatabase = useDatabase
+		}
+
+		if targetDatabase == "" {
+			targetDatabase = session.config.Database
+		}
+
+		if err = ensureCollectionIndexes(goRoutine, target.session, targetDatabase, target.collection, collectionIndexes, dropExtra, indexReport); err != nil {
+			tracelog.CompletedError(err, goRoutine, "EnsureIndexes")
+			return indexReport, err
+		}
+	}
+
+	tracelog.Completedf(goRoutine, "EnsureIndexes", "Created[%d] Changed[%d] Extra[%d] Dropped[%d]", len(indexReport.Created), len(indexReport.Changed), len(indexReport.Extra), len(indexReport.Dropped))
+	return indexReport, err
+}
+
+//** PRIVATE FUNCTIONS
+
+// ensureCollectionIndexes compares the registered indexes of one collection with the existing ones
+func ensureCollectionIndexes(goRoutine string, useSession string, useDatabase string, collectionName string, collectionIndexes []mgo.Index, dropExtra bool, indexReport *IndexReport) (err error) {
+	// Grab a mongo session
+	mongoSession, err := CopySession(goRoutine, useSession)
+	if err != nil {
+		return err
+	}
+
+	defer CloseSession(goRoutine, mongoSession)
+
+	// Access the collection
+	collection, err := GetCollection(mongoSession, useDatabase, collectionName)
+	if err != nil {
+		return err
+	}
+
+	// A collection that does not exist yet has no indexes
+	existing, err := collection.Indexes()
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "ns not found") {
+		return err
+	}
+
+	existingByKey := map[string]mgo.Index{}
+	for _, index := range existing {
+		existingByKey[indexKey(index)] = index
+	}
+
+	registered := map[string]bool{}
+	prefix := fmt.Sprintf("%s.%s.", useDatabase, collectionName)
+
+	for _, index := range collectionIndexes {
+		key := indexKey(index)
+		registered[key] = true
+
+		current, exists := existingByKey[key]
+		if !exists {
+			if err = collection.EnsureIndex(index); err != nil {
+				return fmt.Errorf("Unable To Create Index %s%s : %s", prefix, key, err)
+			}
+
+			tracelog.Trace(goRoutine, "EnsureIndexes", "Info : Created Index : %s%s", prefix, key)
+			indexReport.Created = append(indexReport.Created, prefix+key)
+			continue
+		}
+
+		if current.Unique != index.Unique || current.Sparse != index.Sparse || current.ExpireAfter != index.ExpireAfter {
+			tracelog.Warning(goRoutine, "EnsureIndexes", "Index Options Differ : %s%s", prefix, current.Name)
+			indexReport.Changed = append(indexReport.Changed, prefix+current.Name)
+		}
+	}
+
+	names := make([]string, 0, len(existing))
+	for _, index := range existing {
+		if index.Name == "_id_" || registered[indexKey(index)] {
+			continue
+		}
+
+		names = append(names, index.Name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		indexReport.Extra = append(indexReport.Extra, prefix+name)
+
+		if !dropExtra {
+			tracelog.Warning(goRoutine, "EnsureIndexes", "Index Not Registered : %s%s", prefix, name)
+			continue
+		}
+
+		if err = collection.DropIndexName(name); err != nil {
+			return fmt.Errorf("Unable To Drop Index %s%s : %s", prefix, name, err)
+		}
+
+		tracelog.Trace(goRoutine, "EnsureIndexes", "Info : Dropped Index : %s%s", prefix, name)
+		indexReport.Dropped = append(indexReport.Dropped, prefix+name)
+	}
+
+	return nil
+}
+
+// indexKey identifies an index by its fields, such as type_1_start_date_-1 or location_2dsphere.
+// Registered keys use the mgo syntax, such as $hashed:field, and existing keys are read back by
+// mgo in the same syntax, so both sides map to the same key.
+func indexKey(index mgo.Index) string {
+	parts := make([]string, 0, len(index.Key))
+	for _, field := range index.Key {
+		switch {
+		// A collection has one text index at most and the server reports its fields as
+		// weights or as the _fts and _ftsx keys, so every text index has the same key
+		case strings.HasPrefix(field, "$text:"), field == "_fts", field == "_ftsx":
+			return TEXT_INDEX_KEY
+
+		// $kind:field, such as $hashed:user_id, $2dsphere:location or $2d:location
+		case strings.HasPrefix(field, "$"):
+			if colon := strings.Index(field, ":"); colon > 1 {
+				parts = append(parts, field[colon+1:]+"_"+field[1:colon])
+			} else {
+				parts = append(parts, field)
+			}
+
+		case strings.HasPrefix(field, "@"):
+			parts = append(parts, field[1:]+"_2d")
+		case strings.HasPrefix(field, "-"):
+			parts = append(parts, field[1:]+"_-1")
+		case strings.HasPrefix(field, "+"):
+			parts = append(parts, field[1:]+"_1")
+		default:
+			parts = append(parts, field+"_1")
+		}
+	}
+
+	return strings.Join(parts, "_")
+}
@@ -0,0 +1,40 @@
+// Copyright 2013 Ardan Studios. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"gopkg.in/mgo.v2"
+	"testing"
+)
+
+//** TESTS
+
+// TestIndexKey checks registered keys and the keys mgo reads back from the server match
+func TestIndexKey(t *testing.T) {
+	tests := []struct {
+		registered []string
+		existing   []string // As mgo reads the index back
+		key        string
+	}{
+		{[]string{"type", "-start_date"}, []string{"type", "-start_date"}, "type_1_start_date_-1"},
+		{[]string{"+type"}, []string{"type"}, "type_1"},
+		{[]string{"$hashed:user_id"}, []string{"$hashed:user_id"}, "user_id_hashed"},
+		{[]string{"$2dsphere:location", "type"}, []string{"$2dsphere:location", "type"}, "location_2dsphere_type_1"},
+		{[]string{"@location"}, []string{"$2d:location"}, "location_2d"},
+		{[]string{"$2d:location"}, []string{"$2d:location"}, "location_2d"},
+		{[]string{"$text:title", "$text:body"}, []string{"$text:body", "$text:title"}, TEXT_INDEX_KEY},
+		{[]string{"type", "$text:title"}, []string{"$text:_fts", "_ftsx"}, TEXT_INDEX_KEY},
+	}
+
+	for _, test := range tests {
+		if key := indexKey(mgo.Index{Key: test.registered}); key != test.key {
+			t.Errorf("Registered %v : Expected %s, got %s", test.registered, test.key, key)
+		}
+
+		if key := indexKey(mgo.Index{Key: test.existing}); key != test.key {
+			t.Errorf("Existing %v : Expected %s, got %s", test.existing, test.key, key)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2013 Ardan Studios. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"fmt"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	ERROR_CLASS_NONE      = "none"
+	ERROR_CLASS_NOT_FOUND = "not_found"
+	ERROR_CLASS_DUPLICATE = "duplicate"
+	ERROR_CLASS_TRANSIENT = "transient"
+	ERROR_CLASS_UNHEALTHY = "unhealthy"
+	ERROR_CLASS_OTHER     = "other"
+
+	DEFAULT_SLOW_THRESHOLD = 100 * time.Millisecond
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// slowThreshold is the SlowThreshold in nanoseconds, accessed atomically
+	slowThreshold = int64(DEFAULT_SLOW_THRESHOLD)
+
+	// histogramBuckets are the upper bounds of the duration histogram
+	histogramBuckets = []time.Duration{
+		time.Millisecond,
+		5 * time.Millisecond,
+		10 * time.Millisecond,
+		25 * time.Millisecond,
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		250 * time.Millisecond,
+		500 * time.Millisecond,
+		time.Second,
+		5 * time.Second,
+	}
+
+	metrics      = map[metricKey]*OperationMetrics{} // Metrics by session, collection and operation
+	metricsMutex sync.Mutex                          // Protects metrics
+)
+
+//** TYPES
+
+type (
+	// OperationMetrics counts and times an operation on a collection or a session
+	OperationMetrics struct {
+		Session    string // The session name for CopySession and CloneSession refused while unhealthy
+		Collection string // Empty for session operations
+		Operation  string
+		Count      int
+		Total      time.Duration
+		Max        time.Duration
+		Errors     map[string]int // Count by error class, without ERROR_CLASS_NONE
+		Buckets    []int          // Count by histogramBuckets upper bound, the last for anything longer
+	}
+
+	// metricKey identifies an operation on a collection or a session
+	metricKey struct {
+		session    string
+		collection string
+		operation  string
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// Instrument wraps the call so its duration and error class are recorded against the collection
+// and operation, and it is logged with the query when slower than SlowThreshold(). The wrapper can
+// be passed to Retry so each attempt is measured.
+func Instrument(goRoutine string, collection *mgo.Collection, operation string, query bson.M, call func() error) func() error {
+	return func() error {
+		started := time.Now()
+		err := call()
+		Observe(goRoutine, collection.Name, operation, query, time.Since(started), err)
+		return err
+	}
+}
+
+// Measure runs the call and records it, see Instrument
+func Measure(goRoutine string, collection *mgo.Collection, operation string, query bson.M, call func() error) error {
+	return Instrument(goRoutine, collection, operation, query, call)()
+}
+
+// Observe records an operation that took the duration and logs it if it was slow
+func Observe(goRoutine string, collectionName string, operation string, query bson.M, duration time.Duration, err error) {
+	errorClass := record(metricKey{collection: collectionName, operation: operation}, duration, err)
+
+	if threshold := SlowThreshold(); threshold > 0 && duration >= threshold {
+		tracelog.Warning(goRoutine, operation, "Slow Operation : Collection[%s] Duration[%v] ErrorClass[%s] Query[%s]", collectionName, duration, errorClass, ToString(query))
+	}
+}
+
+// ObserveSession records a session operation such as a CopySession refused while unhealthy
+func ObserveSession(useSession string, operation string, err error) {
+	record(metricKey{session: useSession, operation: operation}, 0, err)
+}
+
+// SlowThreshold returns how long an operation runs before it is logged as slow
+func SlowThreshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&slowThreshold))
+}
+
+// SetSlowThreshold sets how long an operation runs before it is logged as slow. It is set from
+// the mgo_slow_threshold strap at Startup. Zero turns slow logging off.
+func SetSlowThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&slowThreshold, int64(threshold))
+}
+
+// ErrorClass groups errors for the metrics
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ERROR_CLASS_NONE
+	case err == mgo.ErrNotFound:
+		return ERROR_CLASS_NOT_FOUND
+	case mgo.IsDup(err):
+		return ERROR_CLASS_DUPLICATE
+	case IsUnhealthy(err):
+		return ERROR_CLASS_UNHEALTHY
+	case IsTransient(err):
+		return ERROR_CLASS_TRANSIENT
+	}
+
+	return ERROR_CLASS_OTHER
+}
+
+// Metrics returns a copy of the metrics sorted by session, collection and operation
+func Metrics() (operationMetrics []OperationMetrics) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	for _, current := range metrics {
+		snapshot := *current
+		snapshot.Errors = map[string]int{}
+		for errorClass, count := range current.Errors {
+			snapshot.Errors[errorClass] = count
+		}
+		snapshot.Buckets = append([]int(nil), current.Buckets...)
+
+		operationMetrics = append(operationMetrics, snapshot)
+	}
+
+	sort.Slice(operationMetrics, func(i int, j int) bool {
+		if operationMetrics[i].Session != operationMetrics[j].Session {
+			return operationMetrics[i].Session < operationMetrics[j].Session
+		}
+		if operationMetrics[i].Collection != operationMetrics[j].Collection {
+			return operationMetrics[i].Collection < operationMetrics[j].Collection
+		}
+		return operationMetrics[i].Operation < operationMetrics[j].Operation
+	})
+
+	return operationMetrics
+}
+
+// ResetMetrics clears the metrics
+func ResetMetrics() {
+	metricsMutex.Lock()
+	metrics = map[metricKey]*OperationMetrics{}
+	metricsMutex.Unlock()
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format
+func WriteMetrics(writer io.Writer) (err error) {
+	operationMetrics := Metrics()
+
+	fmt.Fprintln(writer, "# TYPE mongo_operations_total counter")
+	for _, current := range operationMetrics {
+		fmt.Fprintf(writer, "mongo_operations_total{%s} %d\n", current.labels(), current.Count)
+	}
+
+	fmt.Fprintln(writer, "# TYPE mongo_operation_errors_total counter")
+	for _, current := range operationMetrics {
+		classes := make([]string, 0, len(current.Errors))
+		for errorClass := range current.Errors {
+			classes = append(classes, errorClass)
+		}
+		sort.Strings(classes)
+
+		for _, errorClass := range classes {
+			fmt.Fprintf(writer, "mongo_operation_errors_total{%s,class=%q} %d\n", current.labels(), errorClass, current.Errors[errorClass])
+		}
+	}
+
+	fmt.Fprintln(writer, "# TYPE mongo_operation_duration_seconds histogram")
+	for _, current := range operationMetrics {
+		cumulative := 0
+		for index, bound := range histogramBuckets {
+			cumulative += current.Buckets[index]
+			fmt.Fprintf(writer, "mongo_operation_duration_seconds_bucket{%s,le=\"%g\"} %d\n", current.labels(), bound.Seconds(), cumulative)
+		}
+
+		fmt.Fprintf(writer, "mongo_operation_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", current.labels(), current.Count)
+		fmt.Fprintf(writer, "mongo_operation_duration_seconds_sum{%s} %g\n", current.labels(), current.Total.Seconds())
+		_, err = fmt.Fprintf(writer, "mongo_operation_duration_seconds_count{%s} %d\n", current.labels(), current.Count)
+	}
+
+	return err
+}
+
+// MetricsHandler serves the metrics for a metrics endpoint
+func MetricsHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteMetrics(writer)
+}
+
+//** MEMBER FUNCTIONS
+
+// Average returns the mean duration of the operation
+func (operationMetrics *OperationMetrics) Average() time.Duration {
+	if operationMetrics.Count == 0 {
+		return 0
+	}
+
+	return operationMetrics.Total / time.Duration(operationMetrics.Count)
+}
+
+// labels returns the metric labels for the operation, with the session for session operations
+func (operationMetrics *OperationMetrics) labels() string {
+	if operationMetrics.Session != "" {
+		return fmt.Sprintf("session=%q,operation=%q", operationMetrics.Session, operationMetrics.Operation)
+	}
+
+	return fmt.Sprintf("collection=%q,operation=%q", operationMetrics.Collection, operationMetrics.Operation)
+}
+
+//** PRIVATE FUNCTIONS
+
+// record adds the operation to the metrics and returns its error class
+func record(key metricKey, duration time.Duration, err error) string {
+	errorClass := ErrorClass(err)
+
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	operationMetrics := metrics[key]
+	if operationMetrics == nil {
+		operationMetrics = &OperationMetrics{
+			Session:    key.session,
+			Collection: key.collection,
+			Operation:  key.operation,
+			Errors:     map[string]int{},
+			Buckets:    make([]int, len(histogramBuckets)+1),
+		}
+		metrics[key] = operationMetrics
+	}
+
+	operationMetrics.Count++
+	operationMetrics.Total += duration
+	if duration > operationMetrics.Max {
+		operationMetrics.Max = duration
+	}
+
+	if errorClass != ERROR_CLASS_NONE {
+		operationMetrics.Errors[errorClass]++
+	}
+
+	bucket := sort.Search(len(histogramBuckets), func(index int) bool {
+		return duration <= histogramBuckets[index]
+	})
+	operationMetrics.Buckets[bucket]++
+
+	return errorClass
+}
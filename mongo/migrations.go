@@ -0,0 +1,599 @@
+// Copyright 2013 Ardan Studios. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/goinggo/task/helper"
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	MIGRATIONS_COLLECTION = "mongo_migrations"
+
+	// MIGRATION_LOCK_ID is the _id of the lock document in the migrations collection
+	MIGRATION_LOCK_ID = "lock"
+
+	DEFAULT_MIGRATION_LOCK_DURATION = 30 * time.Minute
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// ErrMigrationLocked is returned when another process holds the migration lock
+	ErrMigrationLocked = errors.New("Migrations Locked By Another Process")
+
+	// ErrMigrationLockLost is returned when the lock could not be renewed while migrations ran
+	ErrMigrationLockLost = errors.New("Migration Lock Lost")
+
+	migrations      = map[migrationKey]Migration{} // Registered migrations by namespace and version
+	migrationsMutex sync.Mutex                     // Protects migrations
+)
+
+//** TYPES
+
+type (
+	// MigrationFunc changes the database for a migration. It may be run again if it fails part
+	// way through, so it should be safe to repeat.
+	MigrationFunc func(goRoutine string, database *mgo.Database) error
+
+	// Migration is a versioned change to the database. Each package registers its migrations
+	// under its own namespace so their versions do not clash. Migrations are applied in version
+	// order within a namespace and rolled back in reverse. Down may be nil for a migration that
+	// cannot be rolled back.
+	Migration struct {
+		Namespace   string
+		Version     int
+		Description string
+		Up          MigrationFunc
+		Down        MigrationFunc
+	}
+
+	// MigrationOptions selects the migrations to apply or roll back
+	MigrationOptions struct {
+		Namespace    string        // Only migrations in this namespace when set
+		Target       int           // Version to migrate to within Namespace, the latest when zero
+		LockDuration time.Duration // How long the lock is held between renewals, DEFAULT_MIGRATION_LOCK_DURATION when zero
+	}
+
+	// AppliedMigration records a migration in the migrations collection
+	AppliedMigration struct {
+		Id          string        `bson:"_id"`
+		Namespace   string        `bson:"namespace"`
+		Version     int           `bson:"version"`
+		Description string        `bson:"description"`
+		Applied     time.Time     `bson:"applied"`
+		Duration    time.Duration `bson:"duration"`
+		Owner       string        `bson:"owner"`
+	}
+
+	// MigrationLock is the document held while migrations run
+	MigrationLock struct {
+		Id      string    `bson:"_id"`
+		Owner   string    `bson:"owner"`
+		Expires time.Time `bson:"expires"`
+	}
+
+	// MigrationState describes a migration for MigrationStatus
+	MigrationState struct {
+		Namespace   string
+		Version     int
+		Description string
+		Applied     time.Time // Zero while the migration is pending
+		Registered  bool      // False for a migration applied by a newer program
+	}
+
+	// migrationKey identifies a migration
+	migrationKey struct {
+		namespace string
+		version   int
+	}
+
+	// migrationLock is a lock held by this process, renewed until it is released
+	migrationLock struct {
+		collection *mgo.Collection
+		owner      string
+		duration   time.Duration
+		shutdown   chan struct{}
+		once       sync.Once
+		lost       int32 // Set to 1 when the lock could not be renewed before it expired
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// RegisterMigration adds a migration. Packages call it from init. It panics if the version is
+// not positive, has no Up function or is already registered in the namespace.
+func RegisterMigration(migration Migration) {
+	migrationsMutex.Lock()
+	defer migrationsMutex.Unlock()
+
+	if migration.Version <= 0 {
+		panic(fmt.Sprintf("Invalid Migration Version %s", migration.String()))
+	}
+
+	if migration.Up == nil {
+		panic(fmt.Sprintf("Migration %s Has No Up Function", migration.String()))
+	}
+
+	key := migration.key()
+	if _, exists := migrations[key]; exists {
+		panic(fmt.Sprintf("Migration %s Registered Twice", migration.String()))
+	}
+
+	migrations[key] = migration
+}
+
+// Migrations returns the registered migrations in namespace and version order
+func Migrations() []Migration {
+	migrationsMutex.Lock()
+	defer migrationsMutex.Unlock()
+
+	registered := make([]Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		registered = append(registered, migration)
+	}
+
+	sort.Slice(registered, func(i int, j int) bool {
+		return registered[i].before(registered[j])
+	})
+
+	return registered
+}
+
+// MigrationStatus returns every registered or applied migration in namespace and version order
+// and the lock if one is held
+func MigrationStatus(goRoutine string, useSession string, useDatabase string) (migrationStates []MigrationState, lock *MigrationLock, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "MigrationStatus")
+
+	tracelog.Startedf(goRoutine, "MigrationStatus", "UseSession[%s] UseDatabase[%s]", useSession, useDatabase)
+
+	// Grab a mongo session
+	mongoSession, err := CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrationStatus")
+		return migrationStates, lock, err
+	}
+
+	defer CloseSession(goRoutine, mongoSession)
+
+	// Access the migrations collection
+	collection, err := GetCollection(mongoSession, useDatabase, MIGRATIONS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrationStatus")
+		return migrationStates, lock, err
+	}
+
+	applied, err := appliedMigrations(collection)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrationStatus")
+		return migrationStates, lock, err
+	}
+
+	for _, migration := range Migrations() {
+		migrationState := MigrationState{
+			Namespace:   migration.Namespace,
+			Version:     migration.Version,
+			Description: migration.Description,
+			Registered:  true,
+		}
+
+		if appliedMigration, exists := applied[migration.key()]; exists {
+			migrationState.Applied = appliedMigration.Applied
+			delete(applied, migration.key())
+		}
+
+		migrationStates = append(migrationStates, migrationState)
+	}
+
+	for _, appliedMigration := range applied {
+		migrationStates = append(migrationStates, MigrationState{
+			Namespace:   appliedMigration.Namespace,
+			Version:     appliedMigration.Version,
+			Description: appliedMigration.Description,
+			Applied:     appliedMigration.Applied,
+		})
+	}
+
+	sort.Slice(migrationStates, func(i int, j int) bool {
+		if migrationStates[i].Namespace != migrationStates[j].Namespace {
+			return migrationStates[i].Namespace < migrationStates[j].Namespace
+		}
+		return migrationStates[i].Version < migrationStates[j].Version
+	})
+
+	lock = &MigrationLock{}
+	if err = collection.FindId(MIGRATION_LOCK_ID).One(lock); err != nil {
+		lock = nil
+		if err != mgo.ErrNotFound {
+			tracelog.CompletedError(err, goRoutine, "MigrationStatus")
+			return migrationStates, lock, err
+		}
+
+		err = nil
+	}
+
+	tracelog.Completed(goRoutine, "MigrationStatus")
+	return migrationStates, lock, err
+}
+
+// MigrateUp applies the pending migrations selected by the options and returns them. The lock is
+// renewed while the migrations run and the run stops if it is lost. A migration that fails stops
+// the run and is not recorded, so it is tried again next time.
+func MigrateUp(goRoutine string, useSession string, useDatabase string, migrationOptions MigrationOptions) (applied []Migration, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "MigrateUp")
+
+	tracelog.Startedf(goRoutine, "MigrateUp", "UseSession[%s] UseDatabase[%s] Namespace[%s] Target[%d]", useSession, useDatabase, migrationOptions.Namespace, migrationOptions.Target)
+
+	if err = migrationOptions.validate(); err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrateUp")
+		return applied, err
+	}
+
+	// Grab a mongo session
+	mongoSession, err := CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrateUp")
+		return applied, err
+	}
+
+	defer CloseSession(goRoutine, mongoSession)
+
+	// Access the migrations collection
+	collection, err := GetCollection(mongoSession, useDatabase, MIGRATIONS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrateUp")
+		return applied, err
+	}
+
+	lock, err := acquireMigrationLock(goRoutine, collection, migrationOptions.lockDuration())
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrateUp")
+		return applied, err
+	}
+
+	defer lock.release(goRoutine)
+
+	existing, err := appliedMigrations(collection)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrateUp")
+		return applied, err
+	}
+
+	for _, migration := range Migrations() {
+		if !migrationOptions.selects(migration.Namespace, migration.Version) {
+			continue
+		}
+
+		if _, exists := existing[migration.key()]; exists {
+			continue
+		}
+
+		if lock.isLost() {
+			err = ErrMigrationLockLost
+			tracelog.CompletedError(err, goRoutine, "MigrateUp")
+			return applied, err
+		}
+
+		tracelog.Trace(goRoutine, "MigrateUp", "Info : Applying Migration : Migration[%s] Description[%s]", migration.String(), migration.Description)
+
+		started := time.Now()
+		if err = migration.Up(goRoutine, collection.Database); err != nil {
+			err = fmt.Errorf("Migration %s Failed : %s", migration.String(), err)
+			tracelog.CompletedError(err, goRoutine, "MigrateUp")
+			return applied, err
+		}
+
+		// Another process may have taken the lock over while the migration ran
+		if lock.isLost() {
+			err = ErrMigrationLockLost
+			tracelog.CompletedError(err, goRoutine, "MigrateUp")
+			return applied, err
+		}
+
+		appliedMigration := &AppliedMigration{
+			Id:          migration.String(),
+			Namespace:   migration.Namespace,
+			Version:     migration.Version,
+			Description: migration.Description,
+			Applied:     time.Now(),
+			Duration:    time.Since(started),
+			Owner:       lock.owner,
+		}
+
+		if err = collection.Insert(appliedMigration); err != nil {
+			tracelog.CompletedError(err, goRoutine, "MigrateUp")
+			return applied, err
+		}
+
+		applied = append(applied, migration)
+	}
+
+	tracelog.Completedf(goRoutine, "MigrateUp", "Applied[%d]", len(applied))
+	return applied, err
+}
+
+// MigrateDown rolls back the applied migrations newer than the target version, newest first,
+// and returns them. A target of zero rolls back every migration in the namespace, or every
+// migration when no namespace is set. The lock is renewed as in MigrateUp.
+func MigrateDown(goRoutine string, useSession string, useDatabase string, migrationOptions MigrationOptions) (rolledBack []Migration, err error) {
+	defer helper.CatchPanic(&err, goRoutine, "MigrateDown")
+
+	tracelog.Startedf(goRoutine, "MigrateDown", "UseSession[%s] UseDatabase[%s] Namespace[%s] Target[%d]", useSession, useDatabase, migrationOptions.Namespace, migrationOptions.Target)
+
+	if err = migrationOptions.validate(); err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrateDown")
+		return rolledBack, err
+	}
+
+	// Grab a mongo session
+	mongoSession, err := CopySession(goRoutine, useSession)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrateDown")
+		return rolledBack, err
+	}
+
+	defer CloseSession(goRoutine, mongoSession)
+
+	// Access the migrations collection
+	collection, err := GetCollection(mongoSession, useDatabase, MIGRATIONS_COLLECTION)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrateDown")
+		return rolledBack, err
+	}
+
+	lock, err := acquireMigrationLock(goRoutine, collection, migrationOptions.lockDuration())
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrateDown")
+		return rolledBack, err
+	}
+
+	defer lock.release(goRoutine)
+
+	existing, err := appliedMigrations(collection)
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "MigrateDown")
+		return rolledBack, err
+	}
+
+	registered := Migrations()
+
+	// Applied migrations this program does not know cannot be rolled back
+	for key, appliedMigration := range existing {
+		if migrationOptions.rollsBack(key.namespace, key.version) && !containsMigration(registered, key) {
+			err = fmt.Errorf("Migration %s Is Not Registered", appliedMigration.Id)
+			tracelog.CompletedError(err, goRoutine, "MigrateDown")
+			return rolledBack, err
+		}
+	}
+
+	for index := len(registered) - 1; index >= 0; index-- {
+		migration := registered[index]
+		if !migrationOptions.rollsBack(migration.Namespace, migration.Version) {
+			continue
+		}
+
+		if _, exists := existing[migration.key()]; !exists {
+			continue
+		}
+
+		if migration.Down == nil {
+			err = fmt.Errorf("Migration %s Cannot Be Rolled Back", migration.String())
+			tracelog.CompletedError(err, goRoutine, "MigrateDown")
+			return rolledBack, err
+		}
+
+		if lock.isLost() {
+			err = ErrMigrationLockLost
+			tracelog.CompletedError(err, goRoutine, "MigrateDown")
+			return rolledBack, err
+		}
+
+		tracelog.Trace(goRoutine, "MigrateDown", "Info : Rolling Back Migration : Migration[%s] Description[%s]", migration.String(), migration.Description)
+
+		if err = migration.Down(goRoutine, collection.Database); err != nil {
+			err = fmt.Errorf("Rollback Of Migration %s Failed : %s", migration.String(), err)
+			tracelog.CompletedError(err, goRoutine, "MigrateDown")
+			return rolledBack, err
+		}
+
+		if err = collection.RemoveId(migration.String()); err != nil {
+			tracelog.CompletedError(err, goRoutine, "MigrateDown")
+			return rolledBack, err
+		}
+
+		rolledBack = append(rolledBack, migration)
+	}
+
+	tracelog.Completedf(goRoutine, "MigrateDown", "RolledBack[%d]", len(rolledBack))
+	return rolledBack, err
+}
+
+//** MEMBER FUNCTIONS
+
+// String returns the namespace and version that identify the migration, which is also the _id
+// of its applied record
+func (migration Migration) String() string {
+	return fmt.Sprintf("%s:%d", migration.Namespace, migration.Version)
+}
+
+// key returns the registry key of the migration
+func (migration Migration) key() migrationKey {
+	return migrationKey{namespace: migration.Namespace, version: migration.Version}
+}
+
+// before orders migrations by namespace and then version
+func (migration Migration) before(other Migration) bool {
+	if migration.Namespace != other.Namespace {
+		return migration.Namespace < other.Namespace
+	}
+
+	return migration.Version < other.Version
+}
+
+// validate checks a target is only used within a namespace, versions of different namespaces
+// are unrelated
+func (migrationOptions MigrationOptions) validate() error {
+	if migrationOptions.Target < 0 {
+		return fmt.Errorf("Invalid Migration Target %d", migrationOptions.Target)
+	}
+
+	if migrationOptions.Target > 0 && migrationOptions.Namespace == "" {
+		return errors.New("Migration Target Requires A Namespace")
+	}
+
+	return nil
+}
+
+// selects returns true if MigrateUp applies the migration
+func (migrationOptions MigrationOptions) selects(namespace string, version int) bool {
+	if migrationOptions.Namespace != "" && namespace != migrationOptions.Namespace {
+		return false
+	}
+
+	return migrationOptions.Target == 0 || version <= migrationOptions.Target
+}
+
+// rollsBack returns true if MigrateDown rolls the migration back
+func (migrationOptions MigrationOptions) rollsBack(namespace string, version int) bool {
+	if migrationOptions.Namespace != "" && namespace != migrationOptions.Namespace {
+		return false
+	}
+
+	return version > migrationOptions.Target
+}
+
+// lockDuration returns how long the lock is held between renewals
+func (migrationOptions MigrationOptions) lockDuration() time.Duration {
+	if migrationOptions.LockDuration <= 0 {
+		return DEFAULT_MIGRATION_LOCK_DURATION
+	}
+
+	return migrationOptions.LockDuration
+}
+
+// renew extends the lock every third of its duration until it is released. The lock is marked
+// lost when another process took it over, or when it expired before a renewal succeeded.
+func (migrationLock *migrationLock) renew(goRoutine string) {
+	ticker := time.NewTicker(migrationLock.duration / 3)
+	defer ticker.Stop()
+
+	expires := time.Now().Add(migrationLock.duration)
+
+	for {
+		select {
+		case <-ticker.C:
+			renewed := time.Now().Add(migrationLock.duration)
+
+			err := migrationLock.collection.Update(bson.M{"_id": MIGRATION_LOCK_ID, "owner": migrationLock.owner}, bson.M{"$set": bson.M{"expires": renewed}})
+			if err == nil {
+				expires = renewed
+				continue
+			}
+
+			tracelog.Error(err, goRoutine, "renew")
+
+			if err == mgo.ErrNotFound || time.Now().After(expires) {
+				atomic.StoreInt32(&migrationLock.lost, 1)
+				tracelog.Alert(helper.EmailAlertSubject, goRoutine, "renew", "Migration Lock Lost : Owner[%s]", migrationLock.owner)
+				return
+			}
+
+		case <-migrationLock.shutdown:
+			return
+		}
+	}
+}
+
+// isLost returns true once the lock could not be renewed
+func (migrationLock *migrationLock) isLost() bool {
+	return atomic.LoadInt32(&migrationLock.lost) == 1
+}
+
+// release stops the renewal and gives up the lock if this process still holds it
+func (migrationLock *migrationLock) release(goRoutine string) {
+	migrationLock.once.Do(func() {
+		close(migrationLock.shutdown)
+	})
+
+	err := migrationLock.collection.Remove(bson.M{"_id": MIGRATION_LOCK_ID, "owner": migrationLock.owner})
+	if err != nil && err != mgo.ErrNotFound {
+		tracelog.Error(err, goRoutine, "release")
+	}
+}
+
+//** PRIVATE FUNCTIONS
+
+// acquireMigrationLock inserts the lock document, or takes it over if it expired, and renews it
+// until it is released
+func acquireMigrationLock(goRoutine string, collection *mgo.Collection, duration time.Duration) (lock *migrationLock, err error) {
+	hostname, _ := os.Hostname()
+
+	lockDocument := &MigrationLock{
+		Id:      MIGRATION_LOCK_ID,
+		Owner:   fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), bson.NewObjectId().Hex()),
+		Expires: time.Now().Add(duration),
+	}
+
+	lock = &migrationLock{
+		collection: collection,
+		owner:      lockDocument.Owner,
+		duration:   duration,
+		shutdown:   make(chan struct{}),
+	}
+
+	// Nobody holds the lock, otherwise take over a lock whose holder died
+	err = collection.Insert(lockDocument)
+	if mgo.IsDup(err) {
+		err = collection.Update(bson.M{"_id": MIGRATION_LOCK_ID, "expires": bson.M{"$lt": time.Now()}}, lockDocument)
+		if err == mgo.ErrNotFound {
+			return nil, ErrMigrationLocked
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	go lock.renew(goRoutine)
+	return lock, nil
+}
+
+// appliedMigrations loads the applied migrations by namespace and version
+func appliedMigrations(collection *mgo.Collection) (applied map[migrationKey]*AppliedMigration, err error) {
+	var appliedMigrations []*AppliedMigration
+
+	if err = collection.Find(bson.M{"_id": bson.M{"$ne": MIGRATION_LOCK_ID}}).All(&appliedMigrations); err != nil {
+		return nil, err
+	}
+
+	applied = map[migrationKey]*AppliedMigration{}
+	for _, appliedMigration := range appliedMigrations {
+		applied[migrationKey{namespace: appliedMigration.Namespace, version: appliedMigration.Version}] = appliedMigration
+	}
+
+	return applied, err
+}
+
+// containsMigration returns true if the migration is registered
+func containsMigration(registered []Migration, key migrationKey) bool {
+	for _, migration := range registered {
+		if migration.key() == key {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,127 @@
+// Copyright 2013 Ardan Studios. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"gopkg.in/mgo.v2"
+	"testing"
+	"time"
+)
+
+//** TESTS
+
+// TestRegisterMigrationNamespaces checks the same version registers in different namespaces and
+// the migrations are ordered by namespace and then version
+func TestRegisterMigrationNamespaces(t *testing.T) {
+	up := func(goRoutine string, database *mgo.Database) error { return nil }
+
+	registering := []Migration{
+		{Namespace: "reports", Version: 2, Up: up},
+		{Namespace: "data", Version: 1, Up: up},
+		{Namespace: "reports", Version: 1, Up: up},
+	}
+
+	for _, migration := range registering {
+		RegisterMigration(migration)
+	}
+
+	defer func() {
+		migrationsMutex.Lock()
+		for _, migration := range registering {
+			delete(migrations, migration.key())
+		}
+		migrationsMutex.Unlock()
+	}()
+
+	var names []string
+	for _, migration := range Migrations() {
+		names = append(names, migration.String())
+	}
+
+	if len(names) != 3 || names[0] != "data:1" || names[1] != "reports:1" || names[2] != "reports:2" {
+		t.Errorf("Expected [data:1 reports:1 reports:2], got %v", names)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic registering reports:1 twice")
+		}
+	}()
+
+	RegisterMigration(Migration{Namespace: "reports", Version: 1, Up: up})
+}
+
+// TestMigrationOptions checks which migrations are applied and rolled back for the options
+func TestMigrationOptions(t *testing.T) {
+	tests := []struct {
+		migrationOptions MigrationOptions
+		valid            bool
+		selects          []bool // For data:1, data:2, reports:1 and reports:2
+		rollsBack        []bool
+	}{
+		{MigrationOptions{}, true, []bool{true, true, true, true}, []bool{true, true, true, true}},
+		{MigrationOptions{Namespace: "data"}, true, []bool{true, true, false, false}, []bool{true, true, false, false}},
+		{MigrationOptions{Namespace: "data", Target: 1}, true, []bool{true, false, false, false}, []bool{false, true, false, false}},
+		{MigrationOptions{Target: 1}, false, nil, nil},
+		{MigrationOptions{Namespace: "data", Target: -1}, false, nil, nil},
+	}
+
+	migrations := []Migration{{Namespace: "data", Version: 1}, {Namespace: "data", Version: 2}, {Namespace: "reports", Version: 1}, {Namespace: "reports", Version: 2}}
+
+	for _, test := range tests {
+		if err := test.migrationOptions.validate(); (err == nil) != test.valid {
+			t.Errorf("%+v : Expected valid %v, got %v", test.migrationOptions, test.valid, err)
+		}
+
+		if !test.valid {
+			continue
+		}
+
+		for index, migration := range migrations {
+			if selects := test.migrationOptions.selects(migration.Namespace, migration.Version); selects != test.selects[index] {
+				t.Errorf("%+v : Expected %s applied %v, got %v", test.migrationOptions, migration, test.selects[index], selects)
+			}
+
+			if rollsBack := test.migrationOptions.rollsBack(migration.Namespace, migration.Version); rollsBack != test.rollsBack[index] {
+				t.Errorf("%+v : Expected %s rolled back %v, got %v", test.migrationOptions, migration, test.rollsBack[index], rollsBack)
+			}
+		}
+	}
+
+	if duration := (MigrationOptions{}).lockDuration(); duration != DEFAULT_MIGRATION_LOCK_DURATION {
+		t.Errorf("Expected the default lock duration, got %v", duration)
+	}
+}
+
+// TestMigrationLockLost checks the lock is marked lost when a renewal finds another owner
+func TestMigrationLockLost(t *testing.T) {
+	server := startFakeServer(t)
+	defer server.close()
+
+	mongoSession, err := mgo.DialWithTimeout(server.listener.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to dial the fake server : %s", err)
+	}
+	defer mongoSession.Close()
+
+	// The fake server updates nothing, as if another process took the lock over
+	lock := &migrationLock{
+		collection: mongoSession.DB("test").C(MIGRATIONS_COLLECTION),
+		owner:      "test",
+		duration:   30 * time.Millisecond,
+		shutdown:   make(chan struct{}),
+	}
+
+	go lock.renew("test")
+	defer lock.release("test")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !lock.isLost() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the lock to be lost")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
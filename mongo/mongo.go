@@ -15,7 +15,8 @@ import (
 	"github.com/goinggo/tracelog"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -28,7 +29,7 @@ const (
 //** PACKAGE VARIABLES
 
 var (
-	singleton *mongoManager // Reference to the singleton
+	singleton = &mongoManager{sessions: map[string]*mongoSession{}} // Reference to the singleton
 )
 
 //** TYPES
@@ -36,15 +37,28 @@ var (
 type (
 	// mongoManager contains dial and session information
 	mongoSession struct {
+		config          *Config
 		mongoDBDialInfo *mgo.DialInfo
 		mongoSession    *mgo.Session
+		healthMutex     sync.RWMutex // Protects health
+		health          Health
 	}
 
 	// mongoManager manages a map of session
 	mongoManager struct {
+		mutex    sync.RWMutex // Protects the sessions map
 		sessions map[string]*mongoSession
 	}
 
+	// ExecuteOptions overrides the session's read preference, write concern and retries for one call
+	ExecuteOptions struct {
+		Mode         string        // Read mode such as primary, secondaryPreferred or nearest, the session's when empty
+		WriteConcern *WriteConcern // The session's when nil
+		Retry        *RetryPolicy  // Transient errors are retried with it, no retries when nil
+		Operation    string        // Name the call is timed under, Execute when empty
+		Query        bson.M        // Logged when the call is slow
+	}
+
 	// MongoCall defines a type of function that can be used
 	// to excecute code against MongoDB
 	MongoCall func(*mgo.Collection) error
@@ -52,87 +66,158 @@ type (
 
 //** PUBLIC FUNCTIONS
 
-// Startup brings the manager to a running state
+// Startup brings the manager to a running state using the mgo straps. The master session
+// and any sessions named in the mgo_sessions strap are created, see LoadSessionConfigs. If the
+// mgo_health_interval strap is set the health monitor is started, and the mgo_slow_threshold
+// strap sets the SlowThreshold.
 func Startup(goRoutine string) (err error) {
 	defer helper.CatchPanic(&err, goRoutine, "Startup")
 
 	tracelog.Started(goRoutine, "Startup")
 
-	// Create the Mongo Manager
-	singleton = &mongoManager{
-		sessions: map[string]*mongoSession{},
+	// Read the mongodb connection straps
+	configs, err := LoadSessionConfigs()
+	if err != nil {
+		tracelog.CompletedError(err, goRoutine, "Startup")
+		return err
 	}
 
-	// Log the mongodb connection straps
-	tracelog.Trace(goRoutine, "Startup", "MongoDB : Addr[%s]", straps.Strap("mgo_host"))
-	tracelog.Trace(goRoutine, "Startup", "MongoDB : Database[%s]", straps.Strap("mgo_database"))
-	tracelog.Trace(goRoutine, "Startup", "MongoDB : Username[%s]", straps.Strap("mgo_username"))
+	if err = StartupWithSessions(goRoutine, configs); err != nil {
+		tracelog.CompletedError(err, goRoutine, "Startup")
+		return err
+	}
 
-	hosts := strings.Split(straps.Strap("mgo_host"), ",")
+	// Log operations slower than the threshold
+	if value := straps.Strap("mgo_slow_threshold"); value != "" {
+		threshold, err := time.ParseDuration(value)
+		if err != nil {
+			err = fmt.Errorf("Invalid mgo_slow_threshold %s : %s", value, err)
+			tracelog.CompletedError(err, goRoutine, "Startup")
+			return err
+		}
 
-	// Create the master session
-	err = CreateSession(goRoutine, MASTER_SESSION, hosts, straps.Strap("mgo_database"), straps.Strap("mgo_username"), straps.Strap("mgo_password"))
+		SetSlowThreshold(threshold)
+	}
+
+	// Watch the sessions
+	if value := straps.Strap("mgo_health_interval"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			err = fmt.Errorf("Invalid mgo_health_interval %s : %s", value, err)
+			tracelog.CompletedError(err, goRoutine, "Startup")
+			return err
+		}
+
+		if err = StartHealthMonitor(goRoutine, interval); err != nil {
+			tracelog.CompletedError(err, goRoutine, "Startup")
+			return err
+		}
+	}
 
 	tracelog.Completed(goRoutine, "Startup")
 	return err
 }
 
+// StartupWithConfig brings the manager to a running state using the specified settings
+// for the master session
+func StartupWithConfig(goRoutine string, config *Config) (err error) {
+	return StartupWithSessions(goRoutine, map[string]*Config{MASTER_SESSION: config})
+}
+
+// StartupWithSessions brings the manager to a running state creating a session for each of
+// the named settings. The master session is created first and is required. The registered
+// indexes are then made sure of, see EnsureIndexes. Indexes that are not registered are only
+// reported, taskctl indexes -drop removes them.
+func StartupWithSessions(goRoutine string, configs map[string]*Config) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "StartupWithSessions")
+
+	tracelog.Startedf(goRoutine, "StartupWithSessions", "Sessions[%d]", len(configs))
+
+	master := configs[MASTER_SESSION]
+	if master == nil {
+		err = fmt.Errorf("Missing Config For Session %s", MASTER_SESSION)
+		tracelog.CompletedError(err, goRoutine, "StartupWithSessions")
+		return err
+	}
+
+	// Create the master session
+	if err = CreateSessionWithConfig(goRoutine, MASTER_SESSION, master); err != nil {
+		tracelog.CompletedError(err, goRoutine, "StartupWithSessions")
+		return err
+	}
+
+	// Create the named sessions
+	for sessionName, config := range configs {
+		if sessionName == MASTER_SESSION {
+			continue
+		}
+
+		if err = CreateSessionWithConfig(goRoutine, sessionName, config); err != nil {
+			tracelog.CompletedError(err, goRoutine, "StartupWithSessions")
+			return err
+		}
+	}
+
+	// Create the indexes the packages registered
+	if _, err = EnsureIndexes(goRoutine, "", false); err != nil {
+		tracelog.CompletedError(err, goRoutine, "StartupWithSessions")
+		return err
+	}
+
+	tracelog.Completed(goRoutine, "StartupWithSessions")
+	return err
+}
+
 // Shutdown systematically brings the manager down gracefully
 func Shutdown(goRoutine string) (err error) {
 	defer helper.CatchPanic(&err, goRoutine, "Shutdown")
 
 	tracelog.Started(goRoutine, "Shutdown")
 
+	// Stop watching the sessions
+	StopHealthMonitor(goRoutine)
+
 	// Close the databases
-	for _, session := range singleton.sessions {
-		CloseSession(goRoutine, session.mongoSession)
+	for _, sessionName := range ListSessions() {
+		RemoveSession(goRoutine, sessionName)
 	}
 
 	tracelog.Completed(goRoutine, "Shutdown")
 	return err
 }
 
-// CreateSession creates a connection pool for use
+// CreateSession creates a connection pool for use. A session that already exists with the
+// same name is replaced and closed. Copies made from it keep working until they are closed.
 func CreateSession(goRoutine string, sessionName string, hosts []string, databaseName string, username string, password string) (err error) {
-	defer helper.CatchPanic(nil, goRoutine, "CreateSession")
+	config := DefaultConfig()
+	config.Hosts = hosts
+	config.Database = databaseName
+	config.Username = username
+	config.Password = password
 
-	tracelog.Startedf(goRoutine, "CreateSession", "SessionName[%s] Hosts[%s] DatabaseName[%s] Username[%s]", sessionName, hosts, databaseName, username)
+	return CreateSessionWithConfig(goRoutine, sessionName, config)
+}
 
-	// Create the database object
-	mongoSession := &mongoSession{
-		mongoDBDialInfo: &mgo.DialInfo{
-			Addrs:    hosts,
-			Timeout:  60 * time.Second,
-			Database: databaseName,
-			Username: username,
-			Password: password,
-		},
-	}
+// CreateSessionWithConfig creates a connection pool for use with the specified settings. A session
+// that already exists with the same name is replaced and closed.
+func CreateSessionWithConfig(goRoutine string, sessionName string, config *Config) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "CreateSessionWithConfig")
 
-	// Establish the master session
-	mongoSession.mongoSession, err = mgo.DialWithInfo(mongoSession.mongoDBDialInfo)
+	tracelog.Startedf(goRoutine, "CreateSessionWithConfig", "SessionName[%s] %s", sessionName, config)
+
+	mongoSession, err := dialSession(config)
 	if err != nil {
-		tracelog.CompletedError(err, goRoutine, "CreateSession")
+		tracelog.CompletedError(err, goRoutine, "CreateSessionWithConfig")
 		return err
 	}
 
-	// Reads and writes will always be made to the master server using a
-	// unique connection so that reads and writes are fully consistent,
-	// ordered, and observing the most up-to-date data.
-	// http://godoc.org/labix.org/v2/mgo#Session.SetMode
-	mongoSession.mongoSession.SetMode(mgo.Strong, true)
-
-	// Have the session check for errors
-	// http://godoc.org/labix.org/v2/mgo#Session.SetSafe
-	mongoSession.mongoSession.SetSafe(&mgo.Safe{})
-
-	// Don't want any longer than 10 second for an operation to complete
-	mongoSession.mongoSession.SetSyncTimeout(10 * time.Second)
-
 	// Add the database to the map
-	singleton.sessions[sessionName] = mongoSession
+	if previous := singleton.set(sessionName, mongoSession); previous != nil {
+		tracelog.Trace(goRoutine, "CreateSessionWithConfig", "Info : Replaced Session : SessionName[%s]", sessionName)
+		CloseSession(goRoutine, previous.mongoSession)
+	}
 
-	tracelog.Completed(goRoutine, "CreateSession")
+	tracelog.Completed(goRoutine, "CreateSessionWithConfig")
 	return err
 }
 
@@ -148,7 +233,7 @@ func CopySession(goRoutine string, useSession string) (mongoSession *mgo.Session
 	tracelog.Startedf(goRoutine, "CopySession", "UseSession[%s]", useSession)
 
 	// Find the session object
-	session := singleton.sessions[useSession]
+	session := singleton.get(useSession)
 
 	if session == nil {
 		err = fmt.Errorf("Unable To Locate Session %s", useSession)
@@ -156,6 +241,13 @@ func CopySession(goRoutine string, useSession string) (mongoSession *mgo.Session
 		return mongoSession, err
 	}
 
+	// Fail fast instead of handing out a dead connection, counted in the metrics under the session
+	if err = session.healthy(useSession); err != nil {
+		ObserveSession(useSession, "CopySession", err)
+		tracelog.CompletedError(err, goRoutine, "CopySession")
+		return mongoSession, err
+	}
+
 	// Copy the master session
 	mongoSession = session.mongoSession.Copy()
 
@@ -175,7 +267,7 @@ func CloneSession(goRoutine string, useSession string) (mongoSession *mgo.Sessio
 	tracelog.Startedf(goRoutine, "CloneSession", "UseSession[%s]", useSession)
 
 	// Find the session object
-	session := singleton.sessions[useSession]
+	session := singleton.get(useSession)
 
 	if session == nil {
 		err = fmt.Errorf("Unable To Locate Session %s", useSession)
@@ -183,6 +275,13 @@ func CloneSession(goRoutine string, useSession string) (mongoSession *mgo.Sessio
 		return mongoSession, err
 	}
 
+	// Fail fast instead of handing out a dead connection, counted in the metrics under the session
+	if err = session.healthy(useSession); err != nil {
+		ObserveSession(useSession, "CloneSession", err)
+		tracelog.CompletedError(err, goRoutine, "CloneSession")
+		return mongoSession, err
+	}
+
 	// Clone the master session
 	mongoSession = session.mongoSession.Clone()
 
@@ -190,6 +289,39 @@ func CloneSession(goRoutine string, useSession string) (mongoSession *mgo.Sessio
 	return mongoSession, err
 }
 
+// RemoveSession removes the named session and closes it
+func RemoveSession(goRoutine string, sessionName string) (err error) {
+	defer helper.CatchPanic(&err, goRoutine, "RemoveSession")
+
+	tracelog.Startedf(goRoutine, "RemoveSession", "SessionName[%s]", sessionName)
+
+	session := singleton.remove(sessionName)
+
+	if session == nil {
+		err = fmt.Errorf("Unable To Locate Session %s", sessionName)
+		tracelog.CompletedError(err, goRoutine, "RemoveSession")
+		return err
+	}
+
+	CloseSession(goRoutine, session.mongoSession)
+
+	tracelog.Completed(goRoutine, "RemoveSession")
+	return err
+}
+
+// ListSessions returns the names of the sessions in sorted order
+func ListSessions() (sessionNames []string) {
+	singleton.mutex.RLock()
+	defer singleton.mutex.RUnlock()
+
+	for sessionName := range singleton.sessions {
+		sessionNames = append(sessionNames, sessionName)
+	}
+
+	sort.Strings(sessionNames)
+	return sessionNames
+}
+
 // CloseSession puts the connection back into the pool
 func CloseSession(goRoutine string, mongoSession *mgo.Session) {
 	defer helper.CatchPanic(nil, goRoutine, "CloseSession")
@@ -233,10 +365,28 @@ func ToString(queryMap bson.M) string {
 	return string(json)
 }
 
-// Execute the MongoDB literal function
+// Execute the MongoDB literal function. Errors are not retried, use ExecuteWithOptions with a
+// RetryPolicy for calls that are safe to repeat.
 func Execute(goRoutine string, mongoSession *mgo.Session, databaseName string, collectionName string, mongoCall MongoCall) (err error) {
+	return ExecuteWithOptions(goRoutine, mongoSession, databaseName, collectionName, nil, mongoCall)
+}
+
+// ExecuteWithOptions executes the MongoDB literal function with the read preference and write
+// concern from the options. Transient errors are retried only when the options carry a
+// RetryPolicy. The specified session is not changed.
+func ExecuteWithOptions(goRoutine string, mongoSession *mgo.Session, databaseName string, collectionName string, executeOptions *ExecuteOptions, mongoCall MongoCall) (err error) {
 	tracelog.Started(goRoutine, "Execute")
 
+	// Apply the overrides to a clone so the caller's session is untouched
+	if executeOptions != nil {
+		if mongoSession, err = executeOptions.apply(mongoSession); err != nil {
+			tracelog.CompletedError(err, goRoutine, "Execute")
+			return err
+		}
+
+		defer mongoSession.Close()
+	}
+
 	// Capture the specified collection
 	collection, err := GetCollection(mongoSession, databaseName, collectionName)
 	if err != nil {
@@ -245,8 +395,26 @@ func Execute(goRoutine string, mongoSession *mgo.Session, databaseName string, c
 		return err
 	}
 
-	// Execute the mongo call
-	err = mongoCall(collection)
+	retryPolicy := RetryPolicy{Attempts: 1}
+	operation := "Execute"
+	var query bson.M
+
+	if executeOptions != nil {
+		if executeOptions.Retry != nil {
+			retryPolicy = *executeOptions.Retry
+		}
+
+		if executeOptions.Operation != "" {
+			operation = executeOptions.Operation
+		}
+
+		query = executeOptions.Query
+	}
+
+	// Execute the mongo call, timing each attempt
+	err = retryPolicy.Run(goRoutine, mongoSession, "Execute", Instrument(goRoutine, collection, operation, query, func() error {
+		return mongoCall(collection)
+	}))
 	if err != nil {
 
 		tracelog.CompletedError(err, goRoutine, "Execute")
@@ -257,3 +425,116 @@ func Execute(goRoutine string, mongoSession *mgo.Session, databaseName string, c
 
 	return err
 }
+
+//** MEMBER FUNCTIONS
+
+// apply returns a clone of the session with the overrides set
+func (executeOptions *ExecuteOptions) apply(mongoSession *mgo.Session) (*mgo.Session, error) {
+	config := &Config{Mode: executeOptions.Mode}
+
+	mode, err := config.mode()
+	if err != nil {
+		return nil, err
+	}
+
+	clone := mongoSession.Clone()
+
+	if executeOptions.Mode != "" {
+		clone.SetMode(mode, true)
+	}
+
+	if executeOptions.WriteConcern != nil {
+		clone.SetSafe(executeOptions.WriteConcern.safe())
+	}
+
+	return clone, nil
+}
+
+// get returns the named session or nil
+func (mongoManager *mongoManager) get(sessionName string) *mongoSession {
+	mongoManager.mutex.RLock()
+	defer mongoManager.mutex.RUnlock()
+
+	return mongoManager.sessions[sessionName]
+}
+
+// set adds the named session and returns the session it replaced or nil
+func (mongoManager *mongoManager) set(sessionName string, session *mongoSession) (previous *mongoSession) {
+	mongoManager.mutex.Lock()
+	defer mongoManager.mutex.Unlock()
+
+	previous = mongoManager.sessions[sessionName]
+	mongoManager.sessions[sessionName] = session
+	return previous
+}
+
+// swap replaces the named session only if it is still the expected session
+func (mongoManager *mongoManager) swap(sessionName string, expected *mongoSession, session *mongoSession) bool {
+	mongoManager.mutex.Lock()
+	defer mongoManager.mutex.Unlock()
+
+	if mongoManager.sessions[sessionName] != expected {
+		return false
+	}
+
+	mongoManager.sessions[sessionName] = session
+	return true
+}
+
+// remove deletes the named session and returns it or nil
+func (mongoManager *mongoManager) remove(sessionName string) (session *mongoSession) {
+	mongoManager.mutex.Lock()
+	defer mongoManager.mutex.Unlock()
+
+	session = mongoManager.sessions[sessionName]
+	delete(mongoManager.sessions, sessionName)
+	return session
+}
+
+//** PRIVATE FUNCTIONS
+
+// dialSession connects using the settings and applies the session options
+func dialSession(config *Config) (session *mongoSession, err error) {
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+
+	mode, _ := config.mode()
+
+	dialInfo, err := config.dialInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the database object
+	session = &mongoSession{
+		config:          config,
+		mongoDBDialInfo: dialInfo,
+		health:          Health{Healthy: true, LastHealthy: time.Now()},
+	}
+
+	// Establish the master session
+	session.mongoSession, err = mgo.DialWithInfo(session.mongoDBDialInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// The default strong mode makes reads and writes to the primary server using
+	// a unique connection so that reads and writes are fully consistent, ordered,
+	// and observing the most up-to-date data.
+	// http://godoc.org/labix.org/v2/mgo#Session.SetMode
+	session.mongoSession.SetMode(mode, true)
+
+	// Have the session check for errors
+	// http://godoc.org/labix.org/v2/mgo#Session.SetSafe
+	session.mongoSession.SetSafe(config.WriteConcern.safe())
+
+	// Limit how long an operation waits for a server
+	session.mongoSession.SetSyncTimeout(config.SyncTimeout)
+
+	if config.SocketTimeout > 0 {
+		session.mongoSession.SetSocketTimeout(config.SocketTimeout)
+	}
+
+	return session, err
+}
@@ -0,0 +1,403 @@
+// Copyright 2013 Ardan Studios. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//** CONSTANTS
+
+const (
+	opReply = 1
+	opQuery = 2004
+)
+
+//** TYPES
+
+type (
+	// fakeServer answers the commands mgo sends to dial and ping a standalone server
+	fakeServer struct {
+		listener  net.Listener
+		failAll   int32 // Every command fails when 1
+		mutex     sync.Mutex
+		conns     []*fakeConn
+		waitGroup sync.WaitGroup
+	}
+
+	// fakeConn is a connection to the fake server
+	fakeConn struct {
+		net.Conn
+		broken int32 // Ping fails when 1, like a socket to a server that went away
+	}
+)
+
+//** TESTS
+
+// TestSessionRegistryConcurrent creates, copies, clones, removes and lists sessions from many
+// goroutines while the health monitor dials sessions again. Run it with -race.
+func TestSessionRegistryConcurrent(t *testing.T) {
+	server := startFakeServer(t)
+	defer server.close()
+
+	if err := CreateSessionWithConfig("test", MASTER_SESSION, server.config()); err != nil {
+		t.Fatalf("Unable to create the master session : %s", err)
+	}
+	defer Shutdown("test")
+
+	const workers = 8
+	const iterations = 20
+
+	var waitGroup sync.WaitGroup
+
+	for worker := 0; worker < workers; worker++ {
+		waitGroup.Add(1)
+
+		go func(worker int) {
+			defer waitGroup.Done()
+
+			for iteration := 0; iteration < iterations; iteration++ {
+				sessionName := fmt.Sprintf("session%d", (worker+iteration)%3)
+
+				// A dial can fail when its connection is broken before the dial's ping
+				if err := CreateSessionWithConfig("test", sessionName, server.config()); err != nil && !strings.Contains(err.Error(), "fake ping failure") {
+					t.Errorf("Unable to create %s : %s", sessionName, err)
+					return
+				}
+
+				for _, useSession := range []string{MASTER_SESSION, sessionName} {
+					// Another worker may have removed the session, which is fine
+					if mongoSession, err := CopySession("test", useSession); err == nil {
+						CloseSession("test", mongoSession)
+					}
+
+					if mongoSession, err := CloneSession("test", useSession); err == nil {
+						CloseSession("test", mongoSession)
+					}
+				}
+
+				ListSessions()
+				HealthStatus()
+
+				if iteration%5 == 0 {
+					RemoveSession("test", sessionName)
+				}
+			}
+		}(worker)
+	}
+
+	// Break the connections so the health checks dial the sessions again and swap them in
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		for check := 0; check < 5; check++ {
+			server.breakConnections()
+			CheckHealth("test")
+		}
+	}()
+
+	waitGroup.Wait()
+
+	server.breakConnections()
+	CheckHealth("test")
+
+	// The master session was dialed again, so it must still work
+	mongoSession, err := CopyMasterSession("test")
+	if err != nil {
+		t.Fatalf("Unable to copy the master session : %s", err)
+	}
+	defer CloseSession("test", mongoSession)
+
+	if err = mongoSession.Ping(); err != nil {
+		t.Fatalf("Unable to ping with the master session : %s", err)
+	}
+}
+
+// TestSessionHealthRedial checks a session is dialed again when its pings fail
+func TestSessionHealthRedial(t *testing.T) {
+	server := startFakeServer(t)
+	defer server.close()
+
+	if err := CreateSessionWithConfig("test", MASTER_SESSION, server.config()); err != nil {
+		t.Fatalf("Unable to create the master session : %s", err)
+	}
+	defer Shutdown("test")
+
+	before := singleton.get(MASTER_SESSION)
+
+	server.breakConnections()
+	CheckHealth("test")
+
+	after := singleton.get(MASTER_SESSION)
+	if after == before {
+		t.Fatalf("Expected the failed session to be replaced")
+	}
+
+	health, err := SessionHealth(MASTER_SESSION)
+	if err != nil {
+		t.Fatalf("Unable to read the health : %s", err)
+	}
+
+	if !health.Healthy || health.Redials != 1 {
+		t.Fatalf("Expected a healthy session dialed once, got %+v", health)
+	}
+}
+
+// TestSessionUnhealthyFailsFast checks copies fail while the server is down and work again after
+func TestSessionUnhealthyFailsFast(t *testing.T) {
+	server := startFakeServer(t)
+	defer server.close()
+
+	if err := CreateSessionWithConfig("test", MASTER_SESSION, server.config()); err != nil {
+		t.Fatalf("Unable to create the master session : %s", err)
+	}
+	defer Shutdown("test")
+
+	ResetMetrics()
+
+	atomic.StoreInt32(&server.failAll, 1)
+	CheckHealth("test")
+
+	if _, err := CopyMasterSession("test"); !IsUnhealthy(err) {
+		t.Fatalf("Expected an UnhealthyError, got %v", err)
+	}
+
+	if _, err := CloneMasterSession("test"); !IsUnhealthy(err) {
+		t.Fatalf("Expected an UnhealthyError, got %v", err)
+	}
+
+	// The refused copy and clone are counted as unhealthy
+	unhealthy := 0
+	for _, operationMetrics := range Metrics() {
+		if operationMetrics.Session == MASTER_SESSION && operationMetrics.Collection == "" {
+			unhealthy += operationMetrics.Errors[ERROR_CLASS_UNHEALTHY]
+		}
+	}
+
+	if unhealthy != 2 {
+		t.Fatalf("Expected 2 unhealthy errors in the metrics, got %d", unhealthy)
+	}
+
+	// The refusals are labelled with the session rather than a collection
+	var written bytes.Buffer
+	WriteMetrics(&written)
+
+	expected := fmt.Sprintf("mongo_operation_errors_total{session=%q,operation=\"CopySession\",class=%q} 1", MASTER_SESSION, ERROR_CLASS_UNHEALTHY)
+	if !strings.Contains(written.String(), expected) {
+		t.Fatalf("Expected %s in the metrics, got\n%s", expected, written.String())
+	}
+
+	atomic.StoreInt32(&server.failAll, 0)
+	CheckHealth("test")
+
+	mongoSession, err := CopyMasterSession("test")
+	if err != nil {
+		t.Fatalf("Expected the session to recover : %s", err)
+	}
+
+	CloseSession("test", mongoSession)
+}
+
+// TestManagerSwap checks swap only replaces the expected session
+func TestManagerSwap(t *testing.T) {
+	mongoManager := &mongoManager{sessions: map[string]*mongoSession{}}
+
+	first := &mongoSession{}
+	second := &mongoSession{}
+	third := &mongoSession{}
+
+	if previous := mongoManager.set("name", first); previous != nil {
+		t.Fatalf("Expected no previous session")
+	}
+
+	if mongoManager.swap("name", second, third) {
+		t.Fatalf("Expected the swap to fail for a session that is not current")
+	}
+
+	if !mongoManager.swap("name", first, third) || mongoManager.get("name") != third {
+		t.Fatalf("Expected the swap to replace the current session")
+	}
+
+	if mongoManager.remove("name") != third || mongoManager.get("name") != nil {
+		t.Fatalf("Expected the session to be removed")
+	}
+
+	if mongoManager.swap("name", third, first) {
+		t.Fatalf("Expected the swap to fail for a removed session")
+	}
+}
+
+//** PRIVATE FUNCTIONS
+
+// startFakeServer listens on a local port and answers mgo until it is closed
+func startFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen : %s", err)
+	}
+
+	return serveFakeServer(listener)
+}
+
+// serveFakeServer answers mgo on the listener until it is closed
+func serveFakeServer(listener net.Listener) *fakeServer {
+	server := &fakeServer{listener: listener}
+
+	server.waitGroup.Add(1)
+	go func() {
+		defer server.waitGroup.Done()
+
+		for {
+			accepted, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			conn := &fakeConn{Conn: accepted}
+
+			server.mutex.Lock()
+			server.conns = append(server.conns, conn)
+			server.mutex.Unlock()
+
+			server.waitGroup.Add(1)
+			go func() {
+				defer server.waitGroup.Done()
+				server.serve(conn)
+			}()
+		}
+	}()
+
+	return server
+}
+
+// config returns settings that dial the fake server
+func (server *fakeServer) config() *Config {
+	config := DefaultConfig()
+	config.Hosts = []string{server.listener.Addr().String()}
+	config.Database = "test"
+	config.DialTimeout = 2 * time.Second
+	config.SyncTimeout = 2 * time.Second
+	return config
+}
+
+// breakConnections makes pings fail on the open connections, new connections work
+func (server *fakeServer) breakConnections() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for _, conn := range server.conns {
+		atomic.StoreInt32(&conn.broken, 1)
+	}
+}
+
+// close stops listening and drops the connections
+func (server *fakeServer) close() {
+	server.listener.Close()
+
+	server.mutex.Lock()
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.mutex.Unlock()
+
+	server.waitGroup.Wait()
+}
+
+// serve answers each OP_QUERY command on the connection with an OP_REPLY
+func (server *fakeServer) serve(conn *fakeConn) {
+	defer conn.Close()
+
+	header := make([]byte, 16)
+
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		length := int(binary.LittleEndian.Uint32(header[0:]))
+		requestId := binary.LittleEndian.Uint32(header[4:])
+		opCode := binary.LittleEndian.Uint32(header[12:])
+
+		body := make([]byte, length-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		if opCode != opQuery {
+			continue
+		}
+
+		reply, err := bson.Marshal(server.answer(conn, queryCommand(body)))
+		if err != nil {
+			return
+		}
+
+		message := make([]byte, 36, 36+len(reply))
+		binary.LittleEndian.PutUint32(message[0:], uint32(36+len(reply)))
+		binary.LittleEndian.PutUint32(message[8:], requestId)
+		binary.LittleEndian.PutUint32(message[12:], opReply)
+		binary.LittleEndian.PutUint32(message[32:], 1)
+		message = append(message, reply...)
+
+		if _, err := conn.Write(message); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the reply document for the command
+func (server *fakeServer) answer(conn *fakeConn, command string) bson.M {
+	if atomic.LoadInt32(&server.failAll) == 1 {
+		return bson.M{"ok": 0, "errmsg": "fake server down", "code": 91}
+	}
+
+	switch command {
+	case "getnonce":
+		return bson.M{"nonce": "2375531c32080ae8", "ok": 1}
+
+	case "ismaster", "isMaster":
+		return bson.M{"ismaster": true, "ok": 1, "maxWireVersion": 2, "minWireVersion": 0}
+
+	case "ping":
+		if atomic.LoadInt32(&conn.broken) == 1 {
+			return bson.M{"ok": 0, "errmsg": "fake ping failure", "code": 6}
+		}
+	}
+
+	return bson.M{"ok": 1}
+}
+
+// queryCommand returns the name of the command in an OP_QUERY body
+func queryCommand(body []byte) string {
+	// Skip the flags and the collection name
+	offset := 4
+	for offset < len(body) && body[offset] != 0 {
+		offset++
+	}
+
+	// Skip the terminator, number to skip and number to return
+	offset += 9
+	if offset >= len(body) {
+		return ""
+	}
+
+	var command bson.D
+	if err := bson.Unmarshal(body[offset:], &command); err != nil || len(command) == 0 {
+		return ""
+	}
+
+	return command[0].Name
+}
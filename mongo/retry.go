@@ -0,0 +1,138 @@
+// Copyright 2013 Ardan Studios. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"github.com/goinggo/tracelog"
+	"gopkg.in/mgo.v2"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+//** PACKAGE VARIABLES
+
+var (
+	// DefaultRetryPolicy is used by Retry. Pass it in ExecuteOptions to retry an Execute call.
+	DefaultRetryPolicy = RetryPolicy{
+		Attempts:   3,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 2 * time.Second,
+	}
+
+	// transientCodes are server error codes for a primary that stepped down or is unreachable
+	transientCodes = map[int]bool{
+		6:     true, // HostUnreachable
+		7:     true, // HostNotFound
+		89:    true, // NetworkTimeout
+		91:    true, // ShutdownInProgress
+		189:   true, // PrimarySteppedDown
+		9001:  true, // SocketException
+		10107: true, // NotMaster
+		11600: true, // InterruptedAtShutdown
+		11602: true, // InterruptedDueToReplStateChange
+		13435: true, // NotMasterNoSlaveOk
+		13436: true, // NotMasterOrSecondary
+	}
+
+	// transientMessages are error messages mgo returns for dropped or unreachable servers
+	transientMessages = []string{
+		"not master",
+		"no reachable servers",
+		"closed explicitly",
+		"connection reset",
+		"broken pipe",
+		"i/o timeout",
+		"node is recovering",
+	}
+)
+
+//** TYPES
+
+type (
+	// RetryPolicy controls how transient errors are retried
+	RetryPolicy struct {
+		Attempts   int           // Total attempts, one means no retries
+		Backoff    time.Duration // Wait before the first retry, doubled for each retry after
+		MaxBackoff time.Duration // Longest wait between retries
+	}
+)
+
+//** PUBLIC FUNCTIONS
+
+// IsTransient returns true for errors caused by a lost connection or a primary stepping down,
+// which are likely to succeed when retried after the session is refreshed
+func IsTransient(err error) bool {
+	if err == nil || err == mgo.ErrNotFound {
+		return false
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	switch typed := err.(type) {
+	case *mgo.QueryError:
+		if transientCodes[typed.Code] {
+			return true
+		}
+
+	case *mgo.LastError:
+		if transientCodes[typed.Code] {
+			return true
+		}
+	}
+
+	message := strings.ToLower(err.Error())
+	if message == "eof" {
+		return true
+	}
+
+	for _, transient := range transientMessages {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Retry runs the call with the default policy. Use it only for calls that are safe to repeat.
+func Retry(goRoutine string, mongoSession *mgo.Session, functionName string, call func() error) (err error) {
+	return DefaultRetryPolicy.Run(goRoutine, mongoSession, functionName, call)
+}
+
+//** MEMBER FUNCTIONS
+
+// Run runs the call until it succeeds, fails with a permanent error or runs out of attempts.
+// The session is refreshed before each retry so a new primary is found.
+func (retryPolicy RetryPolicy) Run(goRoutine string, mongoSession *mgo.Session, functionName string, call func() error) (err error) {
+	backoff := retryPolicy.Backoff
+
+	for attempt := 1; ; attempt++ {
+		if err = call(); err == nil || !IsTransient(err) || attempt >= retryPolicy.Attempts {
+			return err
+		}
+
+		tracelog.Warning(goRoutine, functionName, "Transient Error, Retrying : Attempt[%d] Of[%d] Backoff[%v] Error[%s]", attempt, retryPolicy.Attempts, backoff, err)
+
+		mongoSession.Refresh()
+
+		// Add jitter so many processes do not retry in step
+		if backoff > 0 {
+			time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		}
+
+		if backoff *= 2; retryPolicy.MaxBackoff > 0 && backoff > retryPolicy.MaxBackoff {
+			backoff = retryPolicy.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 Ardan Studios. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"io/ioutil"
+	"net"
+)
+
+//** CONSTANTS
+
+const (
+	MECHANISM_SCRAM_SHA_1 = "SCRAM-SHA-1"
+	MECHANISM_MONGODB_CR  = "MONGODB-CR"
+	MECHANISM_X509        = "MONGODB-X509"
+	MECHANISM_PLAIN       = "PLAIN"
+	MECHANISM_GSSAPI      = "GSSAPI"
+
+	// X509_AUTH_SOURCE is the database that holds x509 users
+	X509_AUTH_SOURCE = "$external"
+)
+
+//** TYPES
+
+type (
+	// TLSConfig contains the settings for connecting over TLS
+	TLSConfig struct {
+		Enabled    bool
+		CAFile     string // PEM bundle used to verify the servers, the system roots when empty
+		CertFile   string // PEM client certificate, which may also hold the key
+		KeyFile    string // PEM client key when it is not in CertFile
+		ServerName string // Name expected in the server certificates, the dialed host when empty
+		Insecure   bool   // Skip verifying the server certificates, for testing only
+	}
+)
+
+//** MEMBER FUNCTIONS
+
+// tlsConfig builds the crypto/tls settings and returns the subject of the client certificate
+func (tlsConfig *TLSConfig) tlsConfig() (config *tls.Config, subject string, err error) {
+	config = &tls.Config{
+		ServerName:         tlsConfig.ServerName,
+		InsecureSkipVerify: tlsConfig.Insecure,
+	}
+
+	if tlsConfig.CAFile != "" {
+		pem, err := ioutil.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable To Read TLS CA File %s : %s", tlsConfig.CAFile, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, "", fmt.Errorf("No Certificates In TLS CA File %s", tlsConfig.CAFile)
+		}
+	}
+
+	if tlsConfig.CertFile != "" {
+		keyFile := tlsConfig.KeyFile
+		if keyFile == "" {
+			keyFile = tlsConfig.CertFile
+		}
+
+		certificate, err := tls.LoadX509KeyPair(tlsConfig.CertFile, keyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable To Load TLS Client Certificate %s : %s", tlsConfig.CertFile, err)
+		}
+
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable To Parse TLS Client Certificate %s : %s", tlsConfig.CertFile, err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+		subject = leaf.Subject.String()
+	}
+
+	return config, subject, nil
+}
+
+// applyTLS makes the dial settings connect over TLS. An x509 login without a username uses
+// the subject of the client certificate.
+func (config *Config) applyTLS(dialInfo *mgo.DialInfo) (err error) {
+	if !config.TLS.Enabled {
+		return nil
+	}
+
+	tlsConfig, subject, err := config.TLS.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	if config.Mechanism == MECHANISM_X509 {
+		if subject == "" {
+			return fmt.Errorf("Mechanism %s Requires A TLS Client Certificate", MECHANISM_X509)
+		}
+
+		if dialInfo.Username == "" {
+			dialInfo.Username = subject
+		}
+
+		if dialInfo.Source == "" {
+			dialInfo.Source = X509_AUTH_SOURCE
+		}
+	}
+
+	timeout := config.DialTimeout
+
+	dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr.String(), tlsConfig)
+	}
+
+	return nil
+}
+
+//** PRIVATE FUNCTIONS
+
+// validMechanism returns an error for a mechanism mgo does not support
+func validMechanism(mechanism string) error {
+	switch mechanism {
+	case "", MECHANISM_SCRAM_SHA_1, MECHANISM_MONGODB_CR, MECHANISM_X509, MECHANISM_PLAIN, MECHANISM_GSSAPI:
+		return nil
+	}
+
+	return fmt.Errorf("Unsupported Mongo Mechanism %s", mechanism)
+}
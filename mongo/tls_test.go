@@ -0,0 +1,306 @@
+// Copyright 2013 Ardan Studios. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"gopkg.in/mgo.v2"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//** TYPES
+
+type (
+	// testCertificates holds the PEM files of a CA and the server and client certificates it signed
+	testCertificates struct {
+		caFile         string
+		serverCertFile string
+		serverKeyFile  string
+		clientCertFile string
+		clientKeyFile  string
+		clientFile     string // Client certificate and key in one file
+	}
+)
+
+//** TESTS
+
+// TestTLSConfigLoadsFiles checks the CA bundle and the client keypair are loaded
+func TestTLSConfigLoadsFiles(t *testing.T) {
+	certificates := newTestCertificates(t)
+
+	for _, tlsSettings := range []TLSConfig{
+		{Enabled: true, CAFile: certificates.caFile, CertFile: certificates.clientCertFile, KeyFile: certificates.clientKeyFile},
+		{Enabled: true, CAFile: certificates.caFile, CertFile: certificates.clientFile},
+	} {
+		config, subject, err := tlsSettings.tlsConfig()
+		if err != nil {
+			t.Fatalf("Unable to build the TLS settings : %s", err)
+		}
+
+		if config.RootCAs == nil {
+			t.Fatalf("Expected the CA bundle to be loaded")
+		}
+
+		if len(config.Certificates) != 1 {
+			t.Fatalf("Expected the client certificate to be loaded, got %d", len(config.Certificates))
+		}
+
+		if subject != "CN=task,OU=jobs,O=goinggo" {
+			t.Fatalf("Expected the client certificate subject, got %q", subject)
+		}
+	}
+}
+
+// TestTLSConfigRejectsBadFiles checks a bad CA bundle or client keypair is an error
+func TestTLSConfigRejectsBadFiles(t *testing.T) {
+	certificates := newTestCertificates(t)
+
+	notPEM := filepath.Join(t.TempDir(), "bad.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("Unable to write %s : %s", notPEM, err)
+	}
+
+	tests := []struct {
+		name        string
+		tlsSettings TLSConfig
+		message     string
+	}{
+		{"missing CA", TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, "Unable To Read TLS CA File"},
+		{"bad CA", TLSConfig{CAFile: notPEM}, "No Certificates In TLS CA File"},
+		{"bad certificate", TLSConfig{CertFile: notPEM, KeyFile: certificates.clientKeyFile}, "Unable To Load TLS Client Certificate"},
+		{"mismatched key", TLSConfig{CertFile: certificates.clientCertFile, KeyFile: certificates.serverKeyFile}, "Unable To Load TLS Client Certificate"},
+	}
+
+	for _, test := range tests {
+		if _, _, err := test.tlsSettings.tlsConfig(); err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s : Expected an error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+}
+
+// TestApplyTLSX509 checks an x509 login uses the certificate subject and the $external database
+func TestApplyTLSX509(t *testing.T) {
+	certificates := newTestCertificates(t)
+
+	config := DefaultConfig()
+	config.Mechanism = MECHANISM_X509
+	config.TLS = TLSConfig{Enabled: true, CAFile: certificates.caFile, CertFile: certificates.clientCertFile, KeyFile: certificates.clientKeyFile}
+
+	dialInfo := &mgo.DialInfo{}
+	if err := config.applyTLS(dialInfo); err != nil {
+		t.Fatalf("Unable to apply the TLS settings : %s", err)
+	}
+
+	if dialInfo.Username != "CN=task,OU=jobs,O=goinggo" {
+		t.Fatalf("Expected the certificate subject as the username, got %q", dialInfo.Username)
+	}
+
+	if dialInfo.Source != X509_AUTH_SOURCE {
+		t.Fatalf("Expected the %s auth source, got %q", X509_AUTH_SOURCE, dialInfo.Source)
+	}
+
+	if dialInfo.DialServer == nil {
+		t.Fatalf("Expected a TLS dialer")
+	}
+
+	// An explicit username and auth source are kept
+	dialInfo = &mgo.DialInfo{Username: "CN=other", Source: "admin"}
+	if err := config.applyTLS(dialInfo); err != nil {
+		t.Fatalf("Unable to apply the TLS settings : %s", err)
+	}
+
+	if dialInfo.Username != "CN=other" || dialInfo.Source != "admin" {
+		t.Fatalf("Expected the configured login to be kept, got %q %q", dialInfo.Username, dialInfo.Source)
+	}
+
+	// An x509 login needs a client certificate
+	config.TLS.CertFile = ""
+	config.TLS.KeyFile = ""
+	if err := config.applyTLS(&mgo.DialInfo{}); err == nil {
+		t.Fatalf("Expected an error without a client certificate")
+	}
+}
+
+// TestApplyTLSDialsServer checks mgo dials over TLS, verifying the server with the CA bundle
+// and presenting the client certificate
+func TestApplyTLSDialsServer(t *testing.T) {
+	certificates := newTestCertificates(t)
+
+	serverCertificate, err := tls.LoadX509KeyPair(certificates.serverCertFile, certificates.serverKeyFile)
+	if err != nil {
+		t.Fatalf("Unable to load the server certificate : %s", err)
+	}
+
+	caPool := x509.NewCertPool()
+	caPool.AppendCertsFromPEM(readFile(t, certificates.caFile))
+
+	// The server only accepts clients with a certificate signed by the CA
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientCAs:    caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("Unable to listen : %s", err)
+	}
+
+	server := serveFakeServer(listener)
+	defer server.close()
+
+	config := server.config()
+	config.TLS = TLSConfig{Enabled: true, CAFile: certificates.caFile, CertFile: certificates.clientFile}
+
+	dialInfo, err := config.dialInfo()
+	if err != nil {
+		t.Fatalf("Unable to build the dial settings : %s", err)
+	}
+
+	mongoSession, err := mgo.DialWithInfo(dialInfo)
+	if err != nil {
+		t.Fatalf("Unable to dial over TLS : %s", err)
+	}
+	mongoSession.Close()
+
+	// A server name the server certificate does not cover is rejected
+	config.TLS.ServerName = "mongo.example.com"
+	config.DialTimeout = 500 * time.Millisecond
+
+	if dialInfo, err = config.dialInfo(); err != nil {
+		t.Fatalf("Unable to build the dial settings : %s", err)
+	}
+
+	if mongoSession, err = mgo.DialWithInfo(dialInfo); err == nil {
+		mongoSession.Close()
+		t.Fatalf("Expected the server certificate to be rejected")
+	}
+}
+
+//** PRIVATE FUNCTIONS
+
+// newTestCertificates writes a CA and the server and client certificates it signed to a temp directory
+func newTestCertificates(t *testing.T) *testCertificates {
+	directory := t.TempDir()
+	certificates := &testCertificates{
+		caFile:         filepath.Join(directory, "ca.pem"),
+		serverCertFile: filepath.Join(directory, "server.pem"),
+		serverKeyFile:  filepath.Join(directory, "server.key"),
+		clientCertFile: filepath.Join(directory, "client.pem"),
+		clientKeyFile:  filepath.Join(directory, "client.key"),
+		clientFile:     filepath.Join(directory, "client-combined.pem"),
+	}
+
+	caKey := newKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "task test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Unable to create the CA certificate : %s", err)
+	}
+
+	caCertificate, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("Unable to parse the CA certificate : %s", err)
+	}
+
+	writePEM(t, certificates.caFile, "CERTIFICATE", caDER)
+
+	serverKey := newKey(t)
+	serverDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCertificate, &serverKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Unable to create the server certificate : %s", err)
+	}
+
+	writePEM(t, certificates.serverCertFile, "CERTIFICATE", serverDER)
+	writePEM(t, certificates.serverKeyFile, "EC PRIVATE KEY", marshalKey(t, serverKey))
+
+	clientKey := newKey(t)
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "task", OrganizationalUnit: []string{"jobs"}, Organization: []string{"goinggo"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCertificate, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Unable to create the client certificate : %s", err)
+	}
+
+	writePEM(t, certificates.clientCertFile, "CERTIFICATE", clientDER)
+	writePEM(t, certificates.clientKeyFile, "EC PRIVATE KEY", marshalKey(t, clientKey))
+
+	combined := append(readFile(t, certificates.clientCertFile), readFile(t, certificates.clientKeyFile)...)
+	if err = ioutil.WriteFile(certificates.clientFile, combined, 0600); err != nil {
+		t.Fatalf("Unable to write %s : %s", certificates.clientFile, err)
+	}
+
+	return certificates
+}
+
+// newKey generates a P-256 key
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate a key : %s", err)
+	}
+
+	return key
+}
+
+// marshalKey returns the DER form of the key
+func marshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unable to marshal the key : %s", err)
+	}
+
+	return der
+}
+
+// writePEM writes one PEM block to the file
+func writePEM(t *testing.T, fileName string, blockType string, der []byte) {
+	if err := ioutil.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Unable to write %s : %s", fileName, err)
+	}
+}
+
+// readFile returns the contents of the file
+func readFile(t *testing.T, fileName string) []byte {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("Unable to read %s : %s", fileName, err)
+	}
+
+	return contents
+}